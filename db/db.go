@@ -67,7 +67,10 @@ var (
 // limiter chan to cap concurrent Mongo ops
 var mongoLimiter = make(chan struct{}, 100) // allow up to 100 concurrent ops
 
-func init() {
+// Init connects to MongoDB and sets up the collections. It exits the
+// process if MONGODB_URI is unset or the server cannot be reached, and must
+// run before any of the variables above is used.
+func Init() {
 	_ = godotenv.Load()
 
 	uri := os.Getenv("MONGODB_URI")
@@ -2,12 +2,10 @@ package globals
 
 import (
 	"context"
-	"naevis/db"
 	"naevis/rdx"
 	"time"
 
 	"github.com/redis/go-redis/v9"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 const (
@@ -27,7 +25,6 @@ const UserIDKey ContextKey = "userId"
 var CTX = context.Background()
 
 var RedisClient *redis.Client = rdx.Conn
-var MongoClient *mongo.Client = db.Client
 
 // Context keys
 type contextKey string
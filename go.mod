@@ -8,6 +8,7 @@ require (
 	github.com/redis/go-redis/v9 v9.7.1
 	github.com/rs/cors v1.11.1
 	go.mongodb.org/mongo-driver v1.17.3
+	golang.org/x/text v0.23.0
 	golang.org/x/time v0.11.0
 )
 
@@ -24,5 +25,4 @@ require (
 	github.com/xdg-go/stringprep v1.0.4 // indirect
 	github.com/youmark/pkcs8 v0.0.0-20240726163527-a2c0da244d78 // indirect
 	golang.org/x/sync v0.12.0 // indirect
-	golang.org/x/text v0.23.0 // indirect
 )
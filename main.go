@@ -10,6 +10,7 @@ import (
 	"syscall"
 	"time"
 
+	"naevis/db"
 	"naevis/mq"
 	"naevis/ratelim"
 	"naevis/routes"
@@ -70,6 +71,7 @@ func main() {
 	if err := godotenv.Load(); err != nil {
 		log.Println("No .env file found; using system environment")
 	}
+	db.Init()
 
 	// read port
 	port := os.Getenv("PORT")
@@ -104,11 +106,13 @@ func main() {
 	}
 
 	// start indexing worker in background
-	go mq.StartIndexingWorker()
+	workerCtx, stopWorker := context.WithCancel(context.Background())
+	go mq.StartIndexingWorker(workerCtx)
 
-	// on shutdown: stop chat hub, cleanup
+	// on shutdown: stop chat hub, indexing worker, cleanup
 	server.RegisterOnShutdown(func() {
 		log.Println("🛑 Shutting down Searcher...")
+		stopWorker()
 	})
 
 	// start server
@@ -26,13 +26,18 @@ type MPlace struct {
 	CreatedAt   string `json:"created_at"`
 }
 
-// Index represents the incoming JSON event structure.
+// Index represents the incoming JSON event structure. Version orders the
+// events of one entity, higher being newer; Timestamp, the time of the
+// change at the source, is used when Version is unset. Events carrying
+// neither are applied in arrival order.
 type Index struct {
-	EntityType string `json:"entity_type"`
-	Method     string `json:"method"`
-	EntityId   string `json:"entity_id"`
-	ItemId     string `json:"item_id"`
-	ItemType   string `json:"item_type"`
+	EntityType string    `json:"entity_type"`
+	Method     string    `json:"method"`
+	EntityId   string    `json:"entity_id"`
+	ItemId     string    `json:"item_id"`
+	ItemType   string    `json:"item_type"`
+	Version    int64     `json:"version,omitempty"`
+	Timestamp  time.Time `json:"timestamp"`
 }
 
 // Result represents a single search result.
@@ -2,42 +2,315 @@ package mq
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"os"
+	"time"
+
 	"naevis/globals"
 	"naevis/models"
 	"naevis/search"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Stream consumption settings. An entry left pending for claimMinIdle,
+// because its consumer died before settling it, is claimed by the next
+// reclaim pass of any worker and processed again; a live pool keeps its
+// entries from going idle (see pool.hold). Retries that are due are
+// requeued at most readBlock late.
+const (
+	readBatch     = 50
+	readBlock     = 5 * time.Second
+	claimInterval = 30 * time.Second
+	claimMinIdle  = time.Minute
+	claimBatch    = 50
+	retryDelay    = 5 * time.Second
 )
 
-// Index represents an indexing-related message to be emitted.
-type Index struct {
-	EntityType string `json:"entity_type"`
-	Method     string `json:"method"`
-	EntityId   string `json:"entity_id"`
-	ItemId     string `json:"item_id"`
-	ItemType   string `json:"item_type"`
+// StartIndexingWorker consumes the indexing stream until ctx is cancelled,
+// handing entries to a pool of workers partitioned by entity (see pool).
+// An entry is acknowledged once it is indexed or skipped as stale, or its
+// failure has been recorded for a retry or the dead-letter queue.
+func StartIndexingWorker(ctx context.Context) {
+	consumer := consumerName()
+	for {
+		err := search.EnsureIndexingGroup(ctx)
+		if err == nil {
+			break
+		}
+		log.Printf("[IndexingWorker] EnsureIndexingGroup error: %v", err)
+		if !sleepCtx(ctx, retryDelay) {
+			return
+		}
+	}
+	p := newPool(ctx, consumer, workerCount())
+	activePool.Store(p)
+	defer p.stop()
+	log.Printf("[IndexingWorker] Listening on %s as %s with %d workers...", search.IndexingStream, consumer, len(p.partitions))
+
+	// Entries read under this name before a restart are still pending on it.
+	processPending(ctx, p)
+	reclaim(ctx, p)
+	lastClaim := time.Now()
+
+	for ctx.Err() == nil {
+		promoteRetries(ctx)
+		if time.Since(lastClaim) >= claimInterval {
+			reclaim(ctx, p)
+			lastClaim = time.Now()
+		}
+		streams, err := globals.RedisClient.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    search.IndexingGroup,
+			Consumer: consumer,
+			Streams:  []string{search.IndexingStream, ">"},
+			Count:    readBatch,
+			Block:    readBlock,
+		}).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			log.Printf("[IndexingWorker] XReadGroup error: %v", err)
+			sleepCtx(ctx, retryDelay)
+			continue
+		}
+		for _, st := range streams {
+			for _, msg := range st.Messages {
+				p.dispatch(ctx, msg)
+			}
+		}
+	}
+	log.Println("[IndexingWorker] Stopped")
+}
+
+// consumerName identifies this worker in the consumer group. It defaults
+// to the host name so a restarted worker picks up its own pending entries;
+// workers sharing a host must set INDEXING_CONSUMER.
+func consumerName() string {
+	if name := os.Getenv("INDEXING_CONSUMER"); name != "" {
+		return name
+	}
+	if host, err := os.Hostname(); err == nil && host != "" {
+		return host
+	}
+	return fmt.Sprintf("indexer-%d", os.Getpid())
 }
 
-func StartIndexingWorker() {
-	ctx := context.Background()
-	sub := globals.RedisClient.Subscribe(ctx, "indexing-events")
-	ch := sub.Channel()
+// processPending retries the entries already delivered to this consumer.
+func processPending(ctx context.Context, p *pool) {
+	next := "0"
+	for ctx.Err() == nil {
+		streams, err := globals.RedisClient.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    search.IndexingGroup,
+			Consumer: p.consumer,
+			Streams:  []string{search.IndexingStream, next},
+			Count:    claimBatch,
+		}).Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			log.Printf("[IndexingWorker] pending read error: %v", err)
+			return
+		}
+		if len(streams) == 0 || len(streams[0].Messages) == 0 {
+			return
+		}
+		msgs := streams[0].Messages
+		log.Printf("[IndexingWorker] Retrying %d pending entries", len(msgs))
+		for _, msg := range msgs {
+			p.dispatch(ctx, msg)
+		}
+		next = msgs[len(msgs)-1].ID
+	}
+}
 
-	log.Println("[IndexingWorker] Listening for indexing events...")
+// reclaim takes over the entries other consumers left pending for longer
+// than claimMinIdle and processes them.
+func reclaim(ctx context.Context, p *pool) {
+	start := "0-0"
+	for ctx.Err() == nil {
+		msgs, next, err := globals.RedisClient.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   search.IndexingStream,
+			Group:    search.IndexingGroup,
+			Consumer: p.consumer,
+			MinIdle:  claimMinIdle,
+			Start:    start,
+			Count:    claimBatch,
+		}).Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			log.Printf("[IndexingWorker] XAutoClaim error: %v", err)
+			return
+		}
+		if len(msgs) > 0 {
+			log.Printf("[IndexingWorker] Reclaimed %d idle entries", len(msgs))
+		}
+		for _, msg := range msgs {
+			p.dispatch(ctx, msg)
+		}
+		if next == "0-0" || next == "" {
+			return
+		}
+		start = next
+	}
+}
 
-	for msg := range ch {
-		var event models.Index
-		if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
-			log.Printf("[IndexingWorker] Failed to parse event: %v", err)
+// handleBatch indexes the entries a worker drained from its partition. An
+// event that cannot be parsed will never succeed, so it is dead-lettered at
+// once. The others are indexed under their entities' locks, so no two
+// instances index one entity at the same time: the entries of entities
+// locked elsewhere wait for the rest of the batch and are tried again.
+// Entries left pending, such as those of a batch cut short by an error,
+// are picked up again by reclaim.
+func (p *pool) handleBatch(ctx context.Context, jobs []job) {
+	var waiting []job
+	for _, j := range jobs {
+		if j.err != nil {
+			log.Printf("[IndexingWorker] Dead-lettering entry %s: %v", j.msg.ID, j.err)
+			deadLetter(ctx, j.entry, j.err)
 			continue
 		}
-		log.Printf("[IndexingWorker] Processing event=%+v", event)
+		waiting = append(waiting, j)
+	}
 
-		if err := search.IndexDatainRedis(ctx, event); err != nil {
-			log.Printf("[IndexingWorker] IndexDatainRedis error: %v", err)
-		} else {
-			log.Println("[IndexingWorker] Indexing complete")
+	for len(waiting) > 0 {
+		var keys []string
+		seen := map[string]bool{}
+		for _, j := range waiting {
+			if k := j.partitionKey(); !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
 		}
+		held, err := lockEntities(ctx, p.consumer, keys)
+		if err != nil {
+			log.Printf("[IndexingWorker] lock error, leaving %d entries pending: %v", len(waiting), err)
+			return
+		}
+
+		var run, rest []job
+		for _, j := range waiting {
+			if held[j.partitionKey()] {
+				run = append(run, j)
+			} else {
+				rest = append(rest, j)
+			}
+		}
+		if len(run) > 0 {
+			p.applyLocked(ctx, run)
+			locked := make([]string, 0, len(held))
+			for k := range held {
+				locked = append(locked, k)
+			}
+			unlockEntities(ctx, p.consumer, locked)
+		}
+		if waiting = rest; len(waiting) > 0 {
+			metrics.lockWaits.Add(int64(len(waiting)))
+			if !sleepCtx(ctx, entityLockRetry) {
+				return
+			}
+		}
+	}
+}
+
+// applyLocked indexes jobs, whose entities this worker has locked, with one
+// search.IndexEventBatch and acknowledges the ones that succeeded or were
+// skipped. A failed event is handed to FailIndexEvent for a retry with
+// backoff.
+func (p *pool) applyLocked(ctx context.Context, jobs []job) {
+	owned, err := stillOwned(ctx, p.consumer, jobs)
+	if err != nil {
+		log.Printf("[IndexingWorker] pending check error, leaving %d entries pending: %v", len(jobs), err)
+		return
+	}
+	if n := len(jobs) - len(owned); n > 0 {
+		log.Printf("[IndexingWorker] %d entries were reclaimed by another consumer, leaving them to it", n)
+		metrics.lostEntries.Add(int64(n))
+	}
+	var applied []job
+	var events []models.Index
+	for _, j := range owned {
+		log.Printf("[IndexingWorker] Processing entry=%s attempt=%d event=%+v", j.msg.ID, len(j.entry.Attempts)+1, j.event)
+		applied = append(applied, j)
+		events = append(events, j.event)
+	}
+	if len(applied) == 0 {
+		return
+	}
+
+	errs := search.IndexEventBatch(ctx, events)
+	var acks []string
+	indexed := 0
+	for i, j := range applied {
+		err := errs[i]
+		switch {
+		case err == nil:
+			acks = append(acks, j.msg.ID)
+			indexed++
+		case errors.Is(err, search.ErrStaleEvent):
+			log.Printf("[IndexingWorker] Skipped entry %s: %v", j.msg.ID, err)
+			metrics.skipped.Add(1)
+			acks = append(acks, j.msg.ID)
+		default:
+			fail(ctx, j, err)
+		}
+	}
+	if err := search.AckIndexEvent(ctx, acks...); err != nil {
+		log.Printf("[IndexingWorker] ack error for %d entries: %v", len(acks), err)
+	}
+	if indexed > 0 {
+		metrics.indexed.Add(int64(indexed))
+		metrics.lastIndexedAt.Store(time.Now().UnixMilli())
+		log.Printf("[IndexingWorker] Indexed %d entries", indexed)
+	}
+}
+
+// fail records a failed attempt at the entry of j.
+func fail(ctx context.Context, j job, err error) {
+	dead, ferr := search.FailIndexEvent(ctx, j.entry, err)
+	switch {
+	case ferr != nil:
+		log.Printf("[IndexingWorker] IndexEventBatch error: %v; recording failure of entry %s failed, left pending: %v", err, j.msg.ID, ferr)
+	case dead:
+		metrics.deadLettered.Add(1)
+		log.Printf("[IndexingWorker] IndexEventBatch error: %v; entry %s dead-lettered", err, j.msg.ID)
+	default:
+		metrics.retried.Add(1)
+		log.Printf("[IndexingWorker] IndexEventBatch error: %v; entry %s scheduled for retry", err, j.msg.ID)
+	}
+}
+
+func deadLetter(ctx context.Context, entry search.QueuedEvent, cause error) {
+	if err := search.DeadLetterIndexEvent(ctx, entry, cause); err != nil {
+		log.Printf("[IndexingWorker] dead-letter error for entry %s, left pending: %v", entry.ID, err)
+		return
+	}
+	metrics.deadLettered.Add(1)
+}
+
+// promoteRetries requeues the failed events whose backoff has elapsed.
+func promoteRetries(ctx context.Context) {
+	n, err := search.PromoteDueRetries(ctx, claimBatch)
+	if err != nil {
+		log.Printf("[IndexingWorker] PromoteDueRetries error: %v", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("[IndexingWorker] Requeued %d retries", n)
+	}
+}
+
+// sleepCtx waits for d and reports false if ctx was cancelled first.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
 	}
 }
 
@@ -0,0 +1,120 @@
+package mq
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"naevis/globals"
+	"naevis/search"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// -------------------------
+// Entity locks
+// -------------------------
+
+const (
+	// entityLockTTL frees the entities of a worker that died while indexing
+	// them. It stays below claimMinIdle, so by the time another instance
+	// reclaims an entry the lock of its former owner has expired.
+	entityLockTTL = claimMinIdle / 2
+	// entityLockRetry is how long a worker waits before trying again for
+	// entities locked by another instance.
+	entityLockRetry = 200 * time.Millisecond
+)
+
+// entityLockKey holds the consumer name of the instance indexing the entity
+// named by a job's partitionKey.
+func entityLockKey(key string) string { return "indexing:lock:" + key }
+
+// lockEntitiesScript locks every one of KEYS that is free or already held
+// with token ARGV[1] for ARGV[2] ms, and returns 1 for the keys it holds
+// and 0 for the others.
+var lockEntitiesScript = redis.NewScript(`
+local out = {}
+for i, k in ipairs(KEYS) do
+	local v = redis.call("GET", k)
+	if not v or v == ARGV[1] then
+		redis.call("SET", k, ARGV[1], "PX", ARGV[2])
+		out[i] = 1
+	else
+		out[i] = 0
+	end
+end
+return out
+`)
+
+// unlockEntitiesScript deletes the keys of KEYS still held with token
+// ARGV[1], so a worker never frees a lock that expired and was taken by
+// another.
+var unlockEntitiesScript = redis.NewScript(`
+for _, k in ipairs(KEYS) do
+	if redis.call("GET", k) == ARGV[1] then
+		redis.call("DEL", k)
+	end
+end
+return 1
+`)
+
+// lockEntities tries to lock the entities named by keys for token and
+// returns the ones it holds. It never waits for a busy entity.
+func lockEntities(ctx context.Context, token string, keys []string) (map[string]bool, error) {
+	lockKeys := make([]string, len(keys))
+	for i, k := range keys {
+		lockKeys[i] = entityLockKey(k)
+	}
+	res, err := lockEntitiesScript.Run(ctx, globals.RedisClient, lockKeys, token, entityLockTTL.Milliseconds()).Int64Slice()
+	if err != nil {
+		return nil, err
+	}
+	held := make(map[string]bool, len(keys))
+	for i, k := range keys {
+		if i < len(res) && res[i] == 1 {
+			held[k] = true
+		}
+	}
+	return held, nil
+}
+
+// unlockEntities releases the entities named by keys. A lock that cannot
+// be released expires after entityLockTTL.
+func unlockEntities(ctx context.Context, token string, keys []string) {
+	lockKeys := make([]string, len(keys))
+	for i, k := range keys {
+		lockKeys[i] = entityLockKey(k)
+	}
+	if err := unlockEntitiesScript.Run(ctx, globals.RedisClient, lockKeys, token).Err(); err != nil {
+		log.Printf("[IndexingWorker] unlock error for %d entities: %v", len(keys), err)
+	}
+}
+
+// stillOwned returns the jobs whose entries are still pending on consumer.
+// An entry another instance reclaimed while this one stalled is that
+// instance's to index.
+func stillOwned(ctx context.Context, consumer string, jobs []job) ([]job, error) {
+	pipe := globals.RedisClient.Pipeline()
+	cmds := make([]*redis.XPendingExtCmd, len(jobs))
+	for i, j := range jobs {
+		cmds[i] = pipe.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream:   search.IndexingStream,
+			Group:    search.IndexingGroup,
+			Start:    j.msg.ID,
+			End:      j.msg.ID,
+			Count:    1,
+			Consumer: consumer,
+		})
+	}
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+	out := jobs[:0:0]
+	for i, j := range jobs {
+		if len(cmds[i].Val()) > 0 {
+			out = append(out, j)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,225 @@
+package mq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"naevis/globals"
+	"naevis/models"
+	"naevis/search"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// -------------------------
+// Worker pool
+// -------------------------
+
+const (
+	defaultIndexingWorkers = 8
+	maxIndexingWorkers     = 64
+	// partitionBuffer is how many entries a worker may have waiting before
+	// the reader blocks.
+	partitionBuffer = 64
+	// maxBatch bounds the entries a worker applies together; see
+	// handleBatch.
+	maxBatch = 50
+	// holdInterval is how often the entries held by the pool are claimed
+	// again; it must stay well below claimMinIdle.
+	holdInterval = 20 * time.Second
+)
+
+// workerCount reads the pool size from INDEXING_WORKERS.
+func workerCount() int {
+	v := os.Getenv("INDEXING_WORKERS")
+	if v == "" {
+		return defaultIndexingWorkers
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		log.Printf("[IndexingWorker] invalid INDEXING_WORKERS=%q, using %d", v, defaultIndexingWorkers)
+		return defaultIndexingWorkers
+	}
+	return min(n, maxIndexingWorkers)
+}
+
+// job is a stream entry parsed for dispatch; err is set when the entry or
+// its event cannot be parsed.
+type job struct {
+	msg   redis.XMessage
+	entry search.QueuedEvent
+	event models.Index
+	err   error
+}
+
+// partitionKey names the entity an entry is about. Entries that cannot be
+// parsed are spread by their own id.
+func (j job) partitionKey() string {
+	if j.err != nil {
+		return j.msg.ID
+	}
+	return strings.ToLower(j.event.EntityType) + ":" + j.event.EntityId
+}
+
+// pool indexes entries on one goroutine per partition. Every entry of an
+// entity lands on the same partition, so the events of one entity are
+// applied in stream order while different entities are indexed in
+// parallel. A worker applies the entries waiting in its partition as one
+// batch, holding a lock on their entities so that other instances wait for
+// it (see handleBatch). A failed event is retried later from the retry
+// schedule, after newer events of its entity; event versions keep it from
+// undoing them.
+//
+// An entry waiting in a busy partition is not being read from Redis, so
+// the pool claims its held entries again every holdInterval; otherwise
+// another instance's reclaim would see them idle and process them too.
+type pool struct {
+	consumer   string
+	partitions []chan job
+	wg         sync.WaitGroup
+	busy       atomic.Int64
+	done       chan struct{}
+
+	// inflight holds the ids of dispatched entries not yet handled, so an
+	// entry reclaimed while it waits in a partition is not run twice.
+	mu       sync.Mutex
+	inflight map[string]bool
+}
+
+// activePool is the running pool, for Stats.
+var activePool atomic.Pointer[pool]
+
+func newPool(ctx context.Context, consumer string, workers int) *pool {
+	p := &pool{
+		consumer:   consumer,
+		partitions: make([]chan job, workers),
+		inflight:   map[string]bool{},
+		done:       make(chan struct{}),
+	}
+	for i := range p.partitions {
+		ch := make(chan job, partitionBuffer)
+		p.partitions[i] = ch
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for j := range ch {
+				batch := drain(ch, j)
+				// After shutdown the remaining entries stay pending and are
+				// picked up again on restart.
+				if ctx.Err() == nil {
+					p.busy.Add(1)
+					p.handleBatch(ctx, batch)
+					p.busy.Add(-1)
+				}
+				p.mu.Lock()
+				for _, j := range batch {
+					delete(p.inflight, j.msg.ID)
+				}
+				p.mu.Unlock()
+			}
+		}()
+	}
+	go p.hold(ctx)
+	return p
+}
+
+// drain returns first followed by the entries already waiting in ch, up to
+// maxBatch, without blocking.
+func drain(ch chan job, first job) []job {
+	batch := []job{first}
+	for len(batch) < maxBatch {
+		select {
+		case j, ok := <-ch:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, j)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// hold claims the entries held by the pool again every holdInterval, which
+// resets their idle time without counting a delivery, until the pool stops.
+func (p *pool) hold(ctx context.Context) {
+	t := time.NewTicker(holdInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.done:
+			return
+		case <-t.C:
+		}
+		p.mu.Lock()
+		ids := make([]string, 0, len(p.inflight))
+		for id := range p.inflight {
+			ids = append(ids, id)
+		}
+		p.mu.Unlock()
+
+		for start := 0; start < len(ids); start += claimBatch {
+			err := globals.RedisClient.XClaimJustID(ctx, &redis.XClaimArgs{
+				Stream:   search.IndexingStream,
+				Group:    search.IndexingGroup,
+				Consumer: p.consumer,
+				Messages: ids[start:min(start+claimBatch, len(ids))],
+			}).Err()
+			if err != nil && !errors.Is(err, redis.Nil) {
+				metrics.holdErrors.Add(1)
+				log.Printf("[IndexingWorker] hold error: %v", err)
+				break
+			}
+		}
+	}
+}
+
+// dispatch parses msg and queues it on its entity's partition, blocking
+// while that partition is full.
+func (p *pool) dispatch(ctx context.Context, msg redis.XMessage) {
+	j := job{msg: msg}
+	j.entry, j.err = search.ParseIndexEntry(msg)
+	if j.err == nil {
+		j.err = json.Unmarshal(j.entry.Event, &j.event)
+	}
+
+	p.mu.Lock()
+	if p.inflight[msg.ID] {
+		p.mu.Unlock()
+		return
+	}
+	p.inflight[msg.ID] = true
+	p.mu.Unlock()
+
+	h := fnv.New32a()
+	h.Write([]byte(j.partitionKey()))
+	select {
+	case p.partitions[h.Sum32()%uint32(len(p.partitions))] <- j:
+	case <-ctx.Done():
+		p.mu.Lock()
+		delete(p.inflight, msg.ID)
+		p.mu.Unlock()
+	}
+}
+
+// stop lets the workers finish their current entries and waits for them.
+func (p *pool) stop() {
+	close(p.done)
+	for _, ch := range p.partitions {
+		close(ch)
+	}
+	p.wg.Wait()
+	activePool.CompareAndSwap(p, nil)
+}
@@ -0,0 +1,97 @@
+package mq
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"naevis/search"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// -------------------------
+// Worker metrics
+// -------------------------
+
+// metrics counts the entries handled since the process started.
+var metrics struct {
+	indexed       atomic.Int64
+	skipped       atomic.Int64
+	retried       atomic.Int64
+	deadLettered  atomic.Int64
+	holdErrors    atomic.Int64
+	lockWaits     atomic.Int64
+	lostEntries   atomic.Int64
+	lastIndexedAt atomic.Int64 // unix ms
+}
+
+// orderingNote states how far the per-entity ordering of the pool holds.
+var orderingNote = fmt.Sprintf("Events of one entity are applied in stream order by one worker, which "+
+	"locks the entity across instances while it indexes it and skips entries another instance has "+
+	"reclaimed. Held entries are claimed again every %s, and other instances only take over entries idle "+
+	"for %s; an entry reclaimed from a stalled instance is applied after events of its entity that "+
+	"were read later. Event versions keep an older event from undoing a newer one, but unversioned "+
+	"events are not protected.", holdInterval, claimMinIdle)
+
+// WorkerStats is the body of GET /api/v1/admin/indexing/stats. Buffered
+// holds the number of entries waiting in each partition of this process;
+// LockWaits counts the entries that waited for an entity locked by another
+// instance, and LostEntries those left to another instance that reclaimed
+// them. Ordering describes the limits of per-entity ordering across
+// instances.
+type WorkerStats struct {
+	Consumer      string            `json:"consumer"`
+	Workers       int               `json:"workers"`
+	Busy          int64             `json:"busy"`
+	Buffered      []int             `json:"buffered"`
+	Indexed       int64             `json:"indexed"`
+	Skipped       int64             `json:"skipped"`
+	Retried       int64             `json:"retried"`
+	DeadLettered  int64             `json:"dead_lettered"`
+	HoldErrors    int64             `json:"hold_errors"`
+	LockWaits     int64             `json:"lock_waits"`
+	LostEntries   int64             `json:"lost_entries"`
+	LastIndexedAt *time.Time        `json:"last_indexed_at,omitempty"`
+	Queue         search.QueueStats `json:"queue"`
+	Ordering      string            `json:"ordering"`
+}
+
+// StatsHandler reports the indexing queue depth and lag and the activity of
+// this process's workers.
+func StatsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	queue, err := search.IndexingQueueStats(r.Context())
+	if err != nil {
+		log.Printf("[StatsHandler] error: %v", err)
+		utils.RespondWithError(w, http.StatusInternalServerError, "failed to load queue stats")
+		return
+	}
+	s := WorkerStats{
+		Buffered:     []int{},
+		Indexed:      metrics.indexed.Load(),
+		Skipped:      metrics.skipped.Load(),
+		Retried:      metrics.retried.Load(),
+		DeadLettered: metrics.deadLettered.Load(),
+		HoldErrors:   metrics.holdErrors.Load(),
+		LockWaits:    metrics.lockWaits.Load(),
+		LostEntries:  metrics.lostEntries.Load(),
+		Queue:        queue,
+		Ordering:     orderingNote,
+	}
+	if ms := metrics.lastIndexedAt.Load(); ms > 0 {
+		t := time.UnixMilli(ms).UTC()
+		s.LastIndexedAt = &t
+	}
+	if p := activePool.Load(); p != nil {
+		s.Consumer = p.consumer
+		s.Workers = len(p.partitions)
+		s.Busy = p.busy.Load()
+		for _, ch := range p.partitions {
+			s.Buffered = append(s.Buffered, len(ch))
+		}
+	}
+	utils.RespondWithJSON(w, http.StatusOK, s)
+}
@@ -1,6 +1,7 @@
 package routes
 
 import (
+	"naevis/mq"
 	"naevis/ratelim"
 	"naevis/search"
 	"net/http"
@@ -15,6 +16,27 @@ func AddStaticRoutes(router *httprouter.Router) {
 
 func AddSearchRoutes(router *httprouter.Router, rateLimiter *ratelim.RateLimiter) {
 	router.GET("/api/v1/ac", search.Autocompleter)
+	router.GET("/api/v1/search", rateLimiter.Limit(search.UnifiedSearchHandler))
 	router.GET("/api/v1/search/:entityType", rateLimiter.Limit(search.SearchHandler))
+	router.POST("/api/v1/msearch", rateLimiter.Limit(search.MultiSearchHandler))
+	router.GET("/api/v1/entity/:entityType", rateLimiter.Limit(search.EntityBatchHandler))
+	router.GET("/api/v1/entity/:entityType/:id", rateLimiter.Limit(search.EntityHandler))
 	router.POST("/api/v1/emitted", search.EventHandler)
+	router.POST("/api/v1/emitted/bulk", search.BulkIndexHandler)
+
+	router.GET("/api/v1/admin/synonyms", search.RequireAdmin(search.ListSynonymsHandler))
+	router.POST("/api/v1/admin/synonyms", search.RequireAdmin(search.CreateSynonymHandler))
+	router.PUT("/api/v1/admin/synonyms/:id", search.RequireAdmin(search.UpdateSynonymHandler))
+	router.DELETE("/api/v1/admin/synonyms/:id", search.RequireAdmin(search.DeleteSynonymHandler))
+
+	router.GET("/api/v1/admin/stopwords", search.RequireAdmin(search.StopWordsHandler))
+	router.POST("/api/v1/admin/stopwords/apply", search.RequireAdmin(search.ApplyStopWordsHandler))
+	router.GET("/api/v1/admin/stopwords/apply", search.RequireAdmin(search.ApplyStopWordsStatusHandler))
+	router.GET("/api/v1/admin/explain", search.RequireAdmin(search.ExplainHandler))
+
+	router.GET("/api/v1/admin/deadletters", search.RequireAdmin(search.ListDeadLettersHandler))
+	router.GET("/api/v1/admin/deadletters/:id", search.RequireAdmin(search.GetDeadLetterHandler))
+	router.POST("/api/v1/admin/deadletters/:id/replay", search.RequireAdmin(search.ReplayDeadLetterHandler))
+	router.DELETE("/api/v1/admin/deadletters/:id", search.RequireAdmin(search.DiscardDeadLetterHandler))
+	router.GET("/api/v1/admin/indexing/stats", search.RequireAdmin(mq.StatsHandler))
 }
@@ -0,0 +1,31 @@
+package search
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// RequireAdmin guards admin endpoints with the shared secret in the
+// SEARCH_ADMIN_TOKEN environment variable, sent as "Authorization: Bearer
+// <token>". The endpoints are disabled while the variable is unset.
+func RequireAdmin(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		token := os.Getenv("SEARCH_ADMIN_TOKEN")
+		if token == "" {
+			utils.RespondWithError(w, http.StatusForbidden, "admin endpoints are disabled")
+			return
+		}
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			utils.RespondWithError(w, http.StatusUnauthorized, "admin token required")
+			return
+		}
+		next(w, r, ps)
+	}
+}
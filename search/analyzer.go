@@ -0,0 +1,219 @@
+package search
+
+import (
+	"strings"
+)
+
+// -------------------------
+// Analyzer chain
+// -------------------------
+
+// Token is one analysed term and its position in the token stream. Filters
+// that add alternative forms of a word (stems) emit them at the position of
+// the original with Derived set, and removed tokens (stopwords) leave a gap.
+// Stop marks a stop word kept in the stream by AnalyzeWithStops or
+// AnalyzePhrase.
+type Token struct {
+	Term    string
+	Pos     int
+	Derived bool
+	Stop    bool
+}
+
+// CharFilter rewrites raw text before it is tokenized.
+type CharFilter func(string) string
+
+// Tokenizer splits filtered text into terms.
+type Tokenizer func(string) []string
+
+// TokenFilter transforms, removes or adds tokens.
+type TokenFilter func([]Token) []Token
+
+// Analyzer turns text into tokens: CharFilters -> Tokenizer -> StopWords ->
+// Filters. SearchFilters replace Filters when analysing queries (nil means
+// the same as Filters), in the manner of a separate search analyzer: an
+// index-time stemmer can keep the original word next to its stem while the
+// query side only needs the stem.
+//
+// Registered analyzers have no StopWords; analyzerFor returns copies with
+// the configured lists applied (see StopWordConfig).
+type Analyzer struct {
+	Name          string
+	CharFilters   []CharFilter
+	Tokenizer     Tokenizer
+	StopWords     map[string]bool
+	Filters       []TokenFilter
+	SearchFilters []TokenFilter
+
+	// KeepStopsInPhrases makes AnalyzePhrase keep stop words.
+	KeepStopsInPhrases bool
+}
+
+func (a *Analyzer) run(text string, filters []TokenFilter, keepStops bool) []Token {
+	for _, cf := range a.CharFilters {
+		text = cf(text)
+	}
+	terms := a.Tokenizer(text)
+	tokens := make([]Token, 0, len(terms))
+	for i, t := range terms {
+		stop := a.StopWords[t]
+		if stop && !keepStops {
+			continue
+		}
+		tokens = append(tokens, Token{Term: t, Pos: i, Stop: stop})
+	}
+	for _, f := range filters {
+		tokens = f(tokens)
+	}
+	return tokens
+}
+
+func (a *Analyzer) searchFilters() []TokenFilter {
+	if a.SearchFilters != nil {
+		return a.SearchFilters
+	}
+	return a.Filters
+}
+
+// Analyze returns the index-time tokens of text.
+func (a *Analyzer) Analyze(text string) []Token {
+	return a.run(text, a.Filters, false)
+}
+
+// AnalyzeWithStops is Analyze with stop words kept and marked Stop, so
+// their positions can be recorded.
+func (a *Analyzer) AnalyzeWithStops(text string) []Token {
+	return a.run(text, a.Filters, true)
+}
+
+// AnalyzeQuery returns the query-time tokens of text.
+func (a *Analyzer) AnalyzeQuery(text string) []Token {
+	return a.run(text, a.searchFilters(), false)
+}
+
+// AnalyzePhrase returns the query-time tokens of a quoted phrase, keeping
+// stop words (marked Stop) when KeepStopsInPhrases is set.
+func (a *Analyzer) AnalyzePhrase(text string) []Token {
+	return a.run(text, a.searchFilters(), a.KeepStopsInPhrases)
+}
+
+// -------------------------
+// Token filters
+// -------------------------
+
+// stemFilter replaces every word by its stem. Hashtags and stop words are
+// left alone.
+func stemFilter(stem func(string) string) TokenFilter {
+	return func(in []Token) []Token {
+		for i, t := range in {
+			if !t.Stop && !strings.HasPrefix(t.Term, "#") {
+				in[i].Term = stem(t.Term)
+			}
+		}
+		return in
+	}
+}
+
+// keepStemFilter keeps every word and adds its stem at the same position
+// when it differs, so documents match both the surface form and the stem.
+func keepStemFilter(stem func(string) string) TokenFilter {
+	return func(in []Token) []Token {
+		out := make([]Token, 0, len(in))
+		for _, t := range in {
+			out = append(out, t)
+			if t.Stop || strings.HasPrefix(t.Term, "#") {
+				continue
+			}
+			if s := stem(t.Term); s != t.Term {
+				out = append(out, Token{Term: s, Pos: t.Pos, Derived: true})
+			}
+		}
+		return out
+	}
+}
+
+// -------------------------
+// Registry
+// -------------------------
+
+const (
+	StandardAnalyzer = "standard"
+	EnglishAnalyzer  = "english"
+)
+
+var analyzers = map[string]*Analyzer{}
+
+// RegisterAnalyzer makes an analyzer available by name to typeAnalyzers and
+// languageAnalyzers.
+func RegisterAnalyzer(a *Analyzer) {
+	analyzers[a.Name] = a
+}
+
+func init() {
+	RegisterAnalyzer(&Analyzer{
+		Name:        StandardAnalyzer,
+		CharFilters: []CharFilter{normalizeText},
+		Tokenizer:   unicodeTokens,
+	})
+	RegisterAnalyzer(&Analyzer{
+		Name:          EnglishAnalyzer,
+		CharFilters:   []CharFilter{normalizeText},
+		Tokenizer:     unicodeTokens,
+		Filters:       []TokenFilter{keepStemFilter(PorterStem)},
+		SearchFilters: []TokenFilter{stemFilter(PorterStem)},
+	})
+}
+
+// typeAnalyzers picks the analyzer for each entity type. Types made of
+// names (users, artists) are not stemmed.
+var typeAnalyzers = map[string]string{
+	"recipes":   EnglishAnalyzer,
+	"products":  EnglishAnalyzer,
+	"blogposts": EnglishAnalyzer,
+	"feedposts": EnglishAnalyzer,
+	"farms":     EnglishAnalyzer,
+	"crops":     EnglishAnalyzer,
+	"events":    EnglishAnalyzer,
+	"places":    EnglishAnalyzer,
+	"baitos":    EnglishAnalyzer,
+	"merch":     EnglishAnalyzer,
+	"menu":      EnglishAnalyzer,
+}
+
+// languageAnalyzers overrides the type's analyzer for entities that declare
+// a language, keyed by lowercase language code or name.
+var languageAnalyzers = map[string]string{
+	"en":      EnglishAnalyzer,
+	"eng":     EnglishAnalyzer,
+	"english": EnglishAnalyzer,
+}
+
+func defaultAnalyzer() *Analyzer { return analyzerFor("", "") }
+
+// baseAnalyzerFor returns the registered analyzer for an entity of the given
+// type and language; an empty language uses the type's analyzer.
+func baseAnalyzerFor(entityType, language string) *Analyzer {
+	if name, ok := languageAnalyzers[strings.ToLower(strings.TrimSpace(language))]; ok {
+		if a, ok := analyzers[name]; ok {
+			return a
+		}
+	}
+	if name, ok := typeAnalyzers[entityType]; ok {
+		if a, ok := analyzers[name]; ok {
+			return a
+		}
+	}
+	return analyzers[StandardAnalyzer]
+}
+
+// analyzerFor returns the analyzer for an entity of the given type and
+// language with the active stop words applied.
+func analyzerFor(entityType, language string) *Analyzer {
+	return activeStopWords().analyzer(baseAnalyzerFor(entityType, language), entityType)
+}
+
+// searchAnalyzerFor returns the analyzer queries against entityType are
+// analysed with.
+func searchAnalyzerFor(entityType string) *Analyzer {
+	return analyzerFor(entityType, "")
+}
@@ -0,0 +1,97 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAnalyze(t *testing.T) {
+	tests := []struct {
+		analyzer string
+		in       string
+		want     []Token
+	}{
+		{StandardAnalyzer, "Café ＦＡＲＭ", []Token{{Term: "cafe", Pos: 0}, {Term: "farm", Pos: 1}}},
+		{StandardAnalyzer, "#Farming 東京", []Token{{Term: "#farming", Pos: 0}, {Term: "東京", Pos: 1}}},
+		// The index side keeps the original word next to its stem.
+		{EnglishAnalyzer, "farming", []Token{{Term: "farming", Pos: 0}, {Term: "farm", Pos: 0, Derived: true}}},
+		{EnglishAnalyzer, "farm #farming", []Token{{Term: "farm", Pos: 0}, {Term: "#farming", Pos: 1}}},
+	}
+	for _, tt := range tests {
+		if got := analyzers[tt.analyzer].Analyze(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s.Analyze(%q) = %+v, want %+v", tt.analyzer, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestAnalyzeQuery(t *testing.T) {
+	tests := []struct {
+		analyzer string
+		in       string
+		want     []string
+	}{
+		{StandardAnalyzer, "Farming Cafés", []string{"farming", "cafes"}},
+		{EnglishAnalyzer, "Farming Cafés", []string{"farm", "cafe"}},
+		{EnglishAnalyzer, "#Farming ponies", []string{"#farming", "poni"}},
+		{EnglishAnalyzer, "東京タワー", []string{"東京", "京タ", "タワ", "ワー"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, tok := range analyzers[tt.analyzer].AnalyzeQuery(tt.in) {
+			got = append(got, tok.Term)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s.AnalyzeQuery(%q) = %q, want %q", tt.analyzer, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestAnalyzeStopWords(t *testing.T) {
+	a := &Analyzer{
+		Name:        "test",
+		CharFilters: []CharFilter{normalizeText},
+		Tokenizer:   unicodeTokens,
+		StopWords:   map[string]bool{"the": true, "of": true},
+	}
+	// Removed stop words leave a gap in the positions.
+	want := []Token{{Term: "lord", Pos: 1}, {Term: "rings", Pos: 4}}
+	if got := a.Analyze("The Lord of the Rings"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Analyze = %+v, want %+v", got, want)
+	}
+	want = []Token{{Term: "lord", Pos: 0}, {Term: "of", Pos: 1, Stop: true}, {Term: "the", Pos: 2, Stop: true}, {Term: "rings", Pos: 3}}
+	if got := a.AnalyzeWithStops("lord of the rings"); !reflect.DeepEqual(got, want) {
+		t.Errorf("AnalyzeWithStops = %+v, want %+v", got, want)
+	}
+}
+
+func TestParseDocTerms(t *testing.T) {
+	a := &Analyzer{
+		Name:               "test",
+		CharFilters:        []CharFilter{normalizeText},
+		Tokenizer:          unicodeTokens,
+		StopWords:          map[string]bool{"the": true, "of": true},
+		KeepStopsInPhrases: true,
+	}
+	dt := entityTermsWith(Entity{Title: "The Lord of the Rings", Description: "ring lore"}, a)
+	got := parseDocTerms(dt.termMembers())
+	if !reflect.DeepEqual(got.tokens, dt.tokens) {
+		t.Errorf("tokens = %v, want %v", got.tokens, dt.tokens)
+	}
+	for field, tf := range dt.fieldTF {
+		for token := range tf {
+			if _, ok := got.fieldTF[field][token]; !ok {
+				t.Errorf("missing term %s:%s", field, token)
+			}
+		}
+	}
+	for field, stops := range dt.fieldStopPos {
+		for word := range stops {
+			if _, ok := got.fieldStopPos[field][word]; !ok {
+				t.Errorf("missing stop word %s:%s", field, word)
+			}
+		}
+	}
+	if len(got.fieldTF) != len(dt.fieldTF) || len(got.fieldStopPos) != len(dt.fieldStopPos) || len(dt.fieldStopPos) == 0 {
+		t.Errorf("fields = %v / %v, want %v / %v", got.fieldTF, got.fieldStopPos, dt.fieldTF, dt.fieldStopPos)
+	}
+}
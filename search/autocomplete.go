@@ -27,7 +27,7 @@ func AddAutocompleteWords(ctx context.Context, words []string) error {
 	}
 	pipe := globals.RedisClient.Pipeline()
 	for _, w := range words {
-		if w != "" {
+		if w = normalizeText(strings.TrimSpace(w)); w != "" {
 			pipe.ZAdd(ctx, autocompleteZSet(), redis.Z{Score: 0, Member: w})
 		}
 	}
@@ -37,7 +37,7 @@ func AddAutocompleteWords(ctx context.Context, words []string) error {
 
 // Get autocomplete suggestions with optional Redis caching
 func GetAutocompleteSuggestions(ctx context.Context, prefix string, limit int, ttl time.Duration) ([]string, error) {
-	prefix = strings.ToLower(strings.TrimSpace(prefix))
+	prefix = normalizeText(strings.TrimSpace(prefix))
 	if prefix == "" {
 		return nil, nil
 	}
@@ -81,7 +81,7 @@ func Autocompleter(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 		return
 	}
 
-	results, err := GetAutocompleteSuggestions(r.Context(), strings.ToLower(prefix), 20, time.Minute)
+	results, err := GetAutocompleteSuggestions(r.Context(), prefix, 20, time.Minute)
 	if err != nil {
 		log.Printf("Autocompleter error: %v", err)
 		http.Error(w, "Error retrieving autocomplete suggestions", http.StatusInternalServerError)
@@ -0,0 +1,330 @@
+package search
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"naevis/globals"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// BM25 tuning parameters (the usual Lucene/Elasticsearch defaults).
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// docMetaChunk is the number of docmeta hashes, and of documents scored,
+// read per pipeline.
+const docMetaChunk = 500
+
+// maxRankedCandidates bounds the matches scored per query, so ranking costs
+// at most that many documents however long the postings are. It defaults
+// to maxSnapshotHits, every result a search can page to, and
+// SEARCH_MAX_RANKED overrides it. Candidates are scored in order of the
+// best score they could reach, then newest first (see byUpperBound); the
+// others follow them unscored in that order.
+var maxRankedCandidates = loadMaxRankedCandidates()
+
+func loadMaxRankedCandidates() int {
+	v := os.Getenv("SEARCH_MAX_RANKED")
+	if v == "" {
+		return maxSnapshotHits
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		log.Printf("[loadMaxRankedCandidates] invalid SEARCH_MAX_RANKED=%q; using %d", v, maxSnapshotHits)
+		return maxSnapshotHits
+	}
+	return n
+}
+
+// -------------------------
+// Corpus statistics
+// -------------------------
+
+type corpusStats struct {
+	docCount    int64
+	avgFieldLen map[string]float64
+}
+
+// avgLen returns the average length of field, never less than 1.
+func (s corpusStats) avgLen(field string) float64 {
+	if l := s.avgFieldLen[field]; l > 0 {
+		return l
+	}
+	return 1
+}
+
+func getCorpusStats(ctx context.Context) (corpusStats, error) {
+	pipe := globals.RedisClient.Pipeline()
+	countCmd := pipe.HLen(ctx, docLenKey())
+	totalsCmd := pipe.HGetAll(ctx, corpusStatsKey())
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return corpusStats{}, err
+	}
+
+	stats := corpusStats{docCount: countCmd.Val(), avgFieldLen: map[string]float64{}}
+	if stats.docCount == 0 {
+		return stats, nil
+	}
+	for k, v := range totalsCmd.Val() {
+		if !strings.HasPrefix(k, "totallen:") {
+			continue
+		}
+		total, _ := strconv.ParseFloat(v, 64)
+		stats.avgFieldLen[strings.TrimPrefix(k, "totallen:")] = total / float64(stats.docCount)
+	}
+	return stats, nil
+}
+
+// -------------------------
+// Scoring
+// -------------------------
+
+func bm25IDF(docCount int64, docFreq int) float64 {
+	n := float64(docCount)
+	df := float64(docFreq)
+	if df > n {
+		n = df
+	}
+	return math.Log(1 + (n-df+0.5)/(df+0.5))
+}
+
+// bm25Saturate applies BM25's term-frequency saturation to an already
+// length-normalised frequency.
+func bm25Saturate(idf, tf float64) float64 {
+	return idf * tf * (bm25K1 + 1) / (tf + bm25K1)
+}
+
+// bm25MaxScore is the most a token can add to a score: bm25Saturate tends
+// to idf*(k1+1) as the frequency grows.
+func bm25MaxScore(idf, boost float64) float64 {
+	return boost * idf * (bm25K1 + 1)
+}
+
+// fetchDocMetas loads the docmeta hash of every id, in order, docMetaChunk
+// ids per pipeline.
+func fetchDocMetas(ctx context.Context, ids []string) ([]map[string]string, error) {
+	out := make([]map[string]string, 0, len(ids))
+	for start := 0; start < len(ids); start += docMetaChunk {
+		chunk := ids[start:min(start+docMetaChunk, len(ids))]
+		pipe := globals.RedisClient.Pipeline()
+		cmds := make([]*redis.MapStringStringCmd, len(chunk))
+		for i, id := range chunk {
+			cmds[i] = pipe.HGetAll(ctx, docMetaKey(id))
+		}
+		if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+			return nil, err
+		}
+		for _, c := range cmds {
+			out = append(out, c.Val())
+		}
+	}
+	return out, nil
+}
+
+// splitCandidates splits matches, in the order they are to be scored, into
+// the ones to score and the rest; see maxRankedCandidates.
+func splitCandidates(ids []string) (scored, rest []string) {
+	if len(ids) <= maxRankedCandidates {
+		return ids, nil
+	}
+	return ids[:maxRankedCandidates], ids[maxRankedCandidates:]
+}
+
+// bm25Scores computes a BM25F score for every id; see scoreDocs.
+func bm25Scores(ctx context.Context, tokens []string, docFreqs map[string]int, ids []string) (map[string]float64, error) {
+	metas, err := fetchDocMetas(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	return scoreDocs(ctx, tokens, docFreqs, nil, ids, metas, nil)
+}
+
+// scoreDocs computes a BM25F score for every id by summing termScore over
+// tokens. docFreqs maps each token to the size of its posting list, boosts
+// optionally scales the contribution of a token (a missing entry counts as
+// 1) and metas holds the docmeta of each id. When explain is not nil it
+// receives the breakdown of every score.
+func scoreDocs(ctx context.Context, tokens []string, docFreqs map[string]int, boosts map[string]float64, ids []string, metas []map[string]string, explain map[string][]TermScore) (map[string]float64, error) {
+	scores := make(map[string]float64, len(ids))
+	if len(ids) == 0 || len(tokens) == 0 {
+		return scores, nil
+	}
+
+	stats, err := getCorpusStats(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for start := 0; start < len(ids); start += docMetaChunk {
+		end := min(start+docMetaChunk, len(ids))
+		if err := scoreChunk(ctx, stats, tokens, docFreqs, boosts, ids[start:end], metas[start:end], scores, explain); err != nil {
+			return nil, err
+		}
+	}
+	log.Printf("[scoreDocs] N=%d candidates=%d scored=%d", stats.docCount, len(ids), len(scores))
+	return scores, nil
+}
+
+// scoreChunk adds the scores of ids, read in one pipeline, to scores.
+func scoreChunk(ctx context.Context, stats corpusStats, tokens []string, docFreqs map[string]int, boosts map[string]float64, ids []string, metas []map[string]string, scores map[string]float64, explain map[string][]TermScore) error {
+	pipe := globals.RedisClient.Pipeline()
+	tfCmds := make(map[string]map[string]*redis.SliceCmd, len(tokens))
+	for _, t := range tokens {
+		tfCmds[t] = make(map[string]*redis.SliceCmd, len(indexedFields))
+		for _, f := range indexedFields {
+			tfCmds[t][f] = pipe.HMGet(ctx, termFreqKey(f, t), ids...)
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+
+	for i, id := range ids {
+		for _, t := range tokens {
+			tfs := make(map[string]float64, len(indexedFields))
+			for _, f := range indexedFields {
+				if tf := redisFloat(tfCmds[t][f].Val()[i], 0); tf > 0 {
+					tfs[f] = tf
+				}
+			}
+			boost, ok := boosts[t]
+			if !ok {
+				boost = 1
+			}
+			ts := termScore(stats, metas[i], t, tfs, docFreqs[t], boost)
+			scores[id] += ts.Score
+			if explain != nil {
+				explain[id] = append(explain[id], ts)
+			}
+		}
+	}
+	return nil
+}
+
+// termScore is the BM25F contribution of token t to a document with docmeta
+// meta and frequency tfs[f] of t in each field f: the frequencies are
+// length-normalised against each field's average, weighted by the field
+// weights of the document's entity type, summed, and then saturated. A
+// token the document does not contain contributes nothing.
+//
+// Documents indexed before per-field statistics were recorded have neither
+// tf entries nor field lengths; a token they match is counted once at
+// average length.
+func termScore(stats corpusStats, meta map[string]string, t string, tfs map[string]float64, docFreq int, boost float64) TermScore {
+	idf := bm25IDF(stats.docCount, docFreq)
+	ts := TermScore{Term: t, DocFreq: docFreq, IDF: idf, Boost: boost}
+	weights := weightsFor(meta["type"])
+	for _, f := range indexedFields {
+		tf := tfs[f]
+		if tf == 0 {
+			continue
+		}
+		avg := stats.avgLen(f)
+		fieldLen := redisFloat(meta["len:"+f], avg)
+		part := weights[f] * tf / (1 - bm25B + bm25B*fieldLen/avg)
+		ts.PseudoTF += part
+		ts.Fields = append(ts.Fields, FieldScore{Field: f, TF: tf, Length: fieldLen, AvgLength: avg, Weight: weights[f], Contribution: part})
+	}
+	if len(ts.Fields) == 0 {
+		if hasFieldStats(meta) {
+			return ts
+		}
+		ts.Unfielded, ts.PseudoTF = true, 1
+	}
+	ts.Score = boost * bm25Saturate(idf, ts.PseudoTF)
+	return ts
+}
+
+// hasFieldStats reports whether meta records per-field lengths, as it does
+// for every document indexed since fields were weighted separately.
+func hasFieldStats(meta map[string]string) bool {
+	for k := range meta {
+		if strings.HasPrefix(k, "len:") {
+			return true
+		}
+	}
+	return false
+}
+
+// rankByRelevance orders ids by BM25F score, newest first among equal
+// scores. Unlike rankBM25 it does not rely on the input order to break
+// ties, so it suits ids produced by set operations; ids is still expected
+// in scoring order to choose the candidates scored (see splitCandidates).
+// boosts is passed through to scoreDocs.
+func rankByRelevance(ctx context.Context, tokens []string, docFreqs map[string]int, boosts map[string]float64, ids []string) ([]string, error) {
+	log.Printf("[rankByRelevance] START tokens=%v ids=%d", tokens, len(ids))
+	ids, rest := splitCandidates(ids)
+	metas, err := fetchDocMetas(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	scores, err := scoreDocs(ctx, tokens, docFreqs, boosts, ids, metas, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	created := make(map[string]float64, len(ids))
+	for i, id := range ids {
+		created[id] = redisFloat(metas[i]["created"], 0)
+	}
+	out := append([]string(nil), ids...)
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if scores[a] != scores[b] {
+			return scores[a] > scores[b]
+		}
+		if created[a] != created[b] {
+			return created[a] > created[b]
+		}
+		return a < b
+	})
+	out = append(out, rest...)
+	log.Printf("[rankByRelevance] END ids=%d", len(out))
+	return out, nil
+}
+
+// rankBM25 orders ids by their BM25F score for tokens. ids is expected in
+// recency order; the sort is stable so equally relevant documents stay
+// newest-first.
+func rankBM25(ctx context.Context, tokens []string, docFreqs map[string]int, ids []string) ([]string, error) {
+	log.Printf("[rankBM25] START tokens=%v ids=%d", tokens, len(ids))
+	if len(ids) < 2 {
+		return ids, nil
+	}
+	ids, rest := splitCandidates(ids)
+
+	scores, err := bm25Scores(ctx, tokens, docFreqs, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	out := append([]string(nil), ids...)
+	sort.SliceStable(out, func(i, j int) bool { return scores[out[i]] > scores[out[j]] })
+	out = append(out, rest...)
+	log.Printf("[rankBM25] END ids=%d", len(out))
+	return out, nil
+}
+
+// redisFloat converts a Redis reply value to a float, falling back to def
+// when the field is missing or malformed.
+func redisFloat(v interface{}, def float64) float64 {
+	s, ok := v.(string)
+	if !ok {
+		return def
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return def
+	}
+	return f
+}
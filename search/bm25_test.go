@@ -0,0 +1,73 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTermScore(t *testing.T) {
+	stats := corpusStats{docCount: 100, avgFieldLen: map[string]float64{FieldTitle: 4, FieldDescription: 40}}
+	short := map[string]string{"type": "recipes", "len:" + FieldTitle: "3"}
+	long := map[string]string{"type": "recipes", "len:" + FieldTitle: "3", "len:" + FieldDescription: "400"}
+	legacy := map[string]string{"type": "recipes"}
+
+	// docScore sums the term scores of "stew OR soup", as scoreDocs does.
+	docScore := func(meta map[string]string, tfs map[string]map[string]float64) float64 {
+		var sum float64
+		for _, term := range []string{"stew", "soup"} {
+			sum += termScore(stats, meta, term, tfs[term], 5, 1).Score
+		}
+		return sum
+	}
+
+	tests := []struct {
+		name   string
+		better float64
+		worse  float64
+	}{
+		{
+			name:   "one OR term in a long field beats none",
+			better: docScore(long, map[string]map[string]float64{"stew": {FieldDescription: 1}}),
+			worse:  docScore(short, nil),
+		},
+		{
+			name:   "both OR terms beat one",
+			better: docScore(short, map[string]map[string]float64{"stew": {FieldTitle: 1}, "soup": {FieldTitle: 1}}),
+			worse:  docScore(short, map[string]map[string]float64{"stew": {FieldTitle: 1}}),
+		},
+	}
+	for _, tt := range tests {
+		if tt.better <= tt.worse {
+			t.Errorf("%s: %v <= %v", tt.name, tt.better, tt.worse)
+		}
+	}
+
+	if got := termScore(stats, short, "stew", nil, 5, 1); got.Score != 0 || got.Unfielded {
+		t.Errorf("missing term = %+v, want score 0", got)
+	}
+	if got := termScore(stats, legacy, "stew", nil, 5, 1); got.Score <= 0 || !got.Unfielded {
+		t.Errorf("legacy document = %+v, want an unfielded match", got)
+	}
+}
+
+func TestByUpperBound(t *testing.T) {
+	ev := &queryEvaluator{
+		postings: map[string]idSet{
+			invertedKey("stew"):    newIDSet([]string{"new", "newer", "old"}),
+			invertedKey("saffron"): newIDSet([]string{"old", "older"}),
+		},
+		created: map[string]float64{"newer": 4, "new": 3, "old": 2, "older": 1},
+	}
+	stats := corpusStats{docCount: 1000}
+	bounds := map[string]float64{
+		"stew":    bm25MaxScore(bm25IDF(stats.docCount, 900), 1),
+		"saffron": bm25MaxScore(bm25IDF(stats.docCount, 2), 1),
+	}
+	// Documents with the rare term, then those with only the common one,
+	// each newest first.
+	want := []string{"old", "older", "newer", "new"}
+	got := ev.byUpperBound(newIDSet([]string{"new", "newer", "old", "older"}), bounds)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("byUpperBound = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,461 @@
+package search
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"naevis/db"
+	"naevis/globals"
+	"naevis/models"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// -------------------------
+// Bulk indexing
+// -------------------------
+
+const (
+	maxBulkEvents  = 5000
+	maxBulkBodyLen = 16 << 20
+	maxBulkLineLen = 1 << 20
+	// bulkChunkSize is the number of events queued per pipeline, and of
+	// entities fetched and written together by IndexEventBatch.
+	bulkChunkSize = 200
+)
+
+// Outcomes of one line of a bulk request.
+const (
+	BulkQueued  = "queued"
+	BulkFailed  = "failed"
+	BulkInvalid = "invalid"
+	// BulkNotApplied marks the valid lines of a request rejected for its
+	// invalid ones.
+	BulkNotApplied = "not_applied"
+)
+
+// BulkLineResult reports what happened to one line of a bulk request.
+// Line numbers count from 1 and include blank lines; ID is the stream entry
+// of a queued event.
+type BulkLineResult struct {
+	Line       int    `json:"line"`
+	EntityType string `json:"entity_type,omitempty"`
+	EntityID   string `json:"entity_id,omitempty"`
+	Method     string `json:"method,omitempty"`
+	Status     string `json:"status"`
+	ID         string `json:"id,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// BulkIndexResponse is the body of POST /api/v1/emitted/bulk.
+type BulkIndexResponse struct {
+	TookMs  int64            `json:"took_ms"`
+	Counts  map[string]int   `json:"counts"`
+	Results []BulkLineResult `json:"results"`
+}
+
+// bulkEvent is a valid line of a bulk request.
+type bulkEvent struct {
+	result int // index into the report
+	event  models.Index
+}
+
+// parseBulkEvents reads NDJSON indexing events and validates every line.
+// It returns the valid events, a report with one entry per non-blank line
+// and whether any line was invalid.
+func parseBulkEvents(r io.Reader) ([]bulkEvent, []BulkLineResult, bool, error) {
+	var events []bulkEvent
+	var report []BulkLineResult
+	invalid := false
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), maxBulkLineLen)
+	for line := 1; sc.Scan(); line++ {
+		raw := bytes.TrimSpace(sc.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+		if len(report) == maxBulkEvents {
+			return nil, nil, false, fmt.Errorf("at most %d events per request", maxBulkEvents)
+		}
+		res := BulkLineResult{Line: line}
+		var e models.Index
+		err := json.Unmarshal(raw, &e)
+		if err == nil {
+			e.EntityType = strings.ToLower(strings.TrimSpace(e.EntityType))
+			e.Method = strings.ToUpper(strings.TrimSpace(e.Method))
+			e.EntityId = strings.TrimSpace(e.EntityId)
+			res.EntityType, res.EntityID, res.Method = e.EntityType, e.EntityId, e.Method
+			err = validateIndexEvent(e)
+		}
+		if err != nil {
+			res.Status, res.Error = BulkInvalid, err.Error()
+			invalid = true
+		} else {
+			events = append(events, bulkEvent{result: len(report), event: e})
+		}
+		report = append(report, res)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, nil, false, err
+	}
+	return events, report, invalid, nil
+}
+
+func validateIndexEvent(e models.Index) error {
+	switch {
+	case e.EntityId == "":
+		return errors.New("entity_id is required")
+	case rawSources[e.EntityType].idField == "":
+		return fmt.Errorf("unsupported entity type: %q", e.EntityType)
+	}
+	switch e.Method {
+	case "POST", "PUT", "PATCH", "DELETE":
+		return nil
+	}
+	return fmt.Errorf("unsupported method: %q", e.Method)
+}
+
+// EnqueueBulkEvents queues validated events on the indexing stream in
+// order, filling in report. The workers apply them in batches (see
+// IndexEventBatch), in order per entity, with the same version checks,
+// retries and dead-lettering as single events. It fails only when no event
+// could be queued.
+func EnqueueBulkEvents(ctx context.Context, events []bulkEvent, report []BulkLineResult) error {
+	log.Printf("[EnqueueBulkEvents] START events=%d", len(events))
+	queued := 0
+	for start := 0; start < len(events); start += bulkChunkSize {
+		chunk := events[start:min(start+bulkChunkSize, len(events))]
+		pipe := globals.RedisClient.Pipeline()
+		cmds := make([]*redis.StringCmd, len(chunk))
+		for i, be := range chunk {
+			// The normalized event is queued, so the worker sees the type
+			// and method as validated.
+			body, err := json.Marshal(be.event)
+			if err != nil {
+				report[be.result].Status, report[be.result].Error = BulkFailed, err.Error()
+				continue
+			}
+			cmds[i] = pipe.XAdd(ctx, &redis.XAddArgs{
+				Stream: IndexingStream,
+				Values: map[string]interface{}{indexEventField: body},
+			})
+		}
+		// Errors are read per command below.
+		_, _ = pipe.Exec(ctx)
+		for i, be := range chunk {
+			if cmds[i] == nil {
+				continue
+			}
+			res := &report[be.result]
+			id, err := cmds[i].Result()
+			if err != nil {
+				log.Printf("[EnqueueBulkEvents] line=%d enqueue error: %v", res.Line, err)
+				res.Status, res.Error = BulkFailed, "failed to enqueue indexing job"
+				continue
+			}
+			res.Status, res.ID = BulkQueued, id
+			queued++
+		}
+	}
+	log.Printf("[EnqueueBulkEvents] END queued=%d", queued)
+	if queued == 0 && len(events) > 0 {
+		return errors.New("no event could be queued")
+	}
+	return nil
+}
+
+// -------------------------
+// Batched apply
+// -------------------------
+
+// batchOp is the net change a batch makes to one entity: its last event
+// that is not stale, standing for every accepted event before it.
+type batchOp struct {
+	event    models.Index
+	accepted []int          // indexes into the batch
+	applied  []models.Index // the accepted events, normalized
+	entity   Entity         // the new version, for upserts
+	old      *Entity
+	meta     docMeta
+	err      error
+}
+
+func (op *batchOp) deleting() bool { return op.event.Method == "DELETE" }
+
+// IndexEventBatch applies events as IndexDatainRedis would one by one and
+// returns the outcome of each: nil, an ErrStaleEvent or the failure. Events
+// of one entity are checked against each other in order and only the net
+// change per entity is written. Per chunk of bulkChunkSize entities, the
+// source documents are fetched with one $in query per type, the postings
+// are swapped in one Redis transaction and the search collection is
+// updated in one bulk write.
+func IndexEventBatch(ctx context.Context, events []models.Index) []error {
+	log.Printf("[IndexEventBatch] START events=%d", len(events))
+	errs := make([]error, len(events))
+	ops, err := planBatchOps(ctx, events, errs)
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	for start := 0; start < len(ops); start += bulkChunkSize {
+		chunk := ops[start:min(start+bulkChunkSize, len(ops))]
+		err := loadBatchSources(ctx, chunk)
+		if err == nil {
+			err = writeBatchChunk(ctx, chunk)
+		}
+		if err != nil {
+			log.Printf("[IndexEventBatch] chunk error: %v", err)
+		}
+		for _, op := range chunk {
+			if op.err == nil {
+				op.err = err
+			}
+			for _, i := range op.accepted {
+				errs[i] = op.err
+			}
+		}
+	}
+	log.Printf("[IndexEventBatch] END entities=%d", len(ops))
+	return errs
+}
+
+// planBatchOps groups events by entity, recording in errs the stale and
+// unsupported ones.
+func planBatchOps(ctx context.Context, events []models.Index, errs []error) ([]*batchOp, error) {
+	versions, err := getAppliedVersions(ctx, events)
+	if err != nil {
+		return nil, err
+	}
+
+	var ops []*batchOp
+	byKey := map[string]*batchOp{}
+	last := map[string]appliedVersion{}
+	for i, e := range events {
+		e.Method = strings.ToUpper(e.Method)
+		switch e.Method {
+		case "POST", "PUT", "PATCH":
+			if _, ok := rawSources[e.EntityType]; !ok {
+				errs[i] = fmt.Errorf("unsupported entity type: %s", e.EntityType)
+				continue
+			}
+		case "DELETE":
+		default:
+			errs[i] = fmt.Errorf("[IndexEventBatch] unsupported method: %s", e.Method)
+			continue
+		}
+
+		key := entityVersionKey(e.EntityType, e.EntityId)
+		v, seen := last[key]
+		if !seen {
+			v = versions[i]
+		}
+		if reason := staleReason(e, v); reason != "" {
+			errs[i] = fmt.Errorf("%w: %s", ErrStaleEvent, reason)
+			last[key] = v
+			continue
+		}
+		last[key] = v.afterApplying(e)
+		op, ok := byKey[key]
+		if !ok {
+			op = &batchOp{}
+			byKey[key] = op
+			ops = append(ops, op)
+		}
+		op.event = e
+		op.accepted = append(op.accepted, i)
+		op.applied = append(op.applied, e)
+	}
+	return ops, nil
+}
+
+// loadBatchSources fetches the source documents of the upserts in chunk
+// with one $in query per entity type, their indexed versions from the
+// search collection and the docmeta of every entity.
+func loadBatchSources(ctx context.Context, chunk []*batchOp) error {
+	idsByType := map[string][]string{}
+	ids := make([]string, len(chunk))
+	for i, op := range chunk {
+		ids[i] = op.event.EntityId
+		if !op.deleting() {
+			idsByType[op.event.EntityType] = append(idsByType[op.event.EntityType], op.event.EntityId)
+		}
+	}
+	docs := map[string]map[string]interface{}{}
+	for t, tids := range idsByType {
+		found, err := GetResultsByTypeRawBatch(ctx, t, tids)
+		if err != nil {
+			return err
+		}
+		docs[t] = found
+	}
+
+	cur, err := db.Client.Database("naevis").Collection("search").
+		Find(ctx, bson.M{"entityid": bson.M{"$in": ids}})
+	if err != nil {
+		return err
+	}
+	var indexed []Entity
+	if err := cur.All(ctx, &indexed); err != nil {
+		return err
+	}
+	old := make(map[string]*Entity, len(indexed))
+	for i := range indexed {
+		old[indexed[i].EntityID] = &indexed[i]
+	}
+
+	metas, err := getDocMetas(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	for i, op := range chunk {
+		op.old = old[op.event.EntityId]
+		op.meta = metas[i]
+		if op.deleting() {
+			continue
+		}
+		data, ok := docs[op.event.EntityType][op.event.EntityId]
+		if !ok {
+			op.err = fmt.Errorf("%s %s: %w", op.event.EntityType, op.event.EntityId, mongo.ErrNoDocuments)
+			continue
+		}
+		if op.entity, err = ConvertToEntity(ctx, data); err != nil {
+			op.err = err
+		}
+	}
+	return nil
+}
+
+// writeBatchChunk swaps the postings of a chunk of entities in one Redis
+// transaction, as UpdateEntityIndexes and DeleteEntity do for one, then
+// updates the search collection in one bulk write and records the event
+// versions.
+func writeBatchChunk(ctx context.Context, chunk []*batchOp) error {
+	applied, err := appliedStopWords(ctx)
+	if err != nil {
+		return err
+	}
+	pipe := globals.RedisClient.TxPipeline()
+	var writes []mongo.WriteModel
+	var done []*batchOp
+	for _, op := range chunk {
+		if op.err != nil {
+			continue
+		}
+		id := op.event.EntityId
+		switch {
+		case op.deleting():
+			if op.old == nil {
+				// Never indexed, or deleted already; the tombstone still
+				// has to reject a late create.
+				break
+			}
+			unindexDocPipeline(ctx, pipe, id, indexedTerms(*op.old, applied), op.meta)
+			writes = append(writes, mongo.NewDeleteOneModel().SetFilter(bson.M{"entityid": id}))
+		default:
+			newTerms := entityTerms(op.entity)
+			switch {
+			case op.old == nil:
+				removeDocStatsPipeline(ctx, pipe, id, op.meta)
+				if len(newTerms.tokens) > 0 {
+					indexDocPipeline(ctx, pipe, op.entity, newTerms)
+				}
+			case op.meta.indexed && op.meta.entityType == op.entity.EntityType &&
+				reflect.DeepEqual(indexedTerms(*op.old, applied), newTerms) && sameAttributes(*op.old, op.entity):
+				// Unchanged postings; only the stored entity is refreshed.
+			default:
+				unindexDocPipeline(ctx, pipe, id, indexedTerms(*op.old, applied), op.meta)
+				if len(newTerms.tokens) > 0 {
+					indexDocPipeline(ctx, pipe, op.entity, newTerms)
+				}
+			}
+			writes = append(writes, mongo.NewReplaceOneModel().
+				SetFilter(bson.M{"entityid": id, "entitytype": op.entity.EntityType}).
+				SetReplacement(op.entity).
+				SetUpsert(true))
+		}
+		done = append(done, op)
+	}
+	if len(done) == 0 {
+		return nil
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	if len(writes) > 0 {
+		_, err := db.Client.Database("naevis").Collection("search").
+			BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+		if err != nil {
+			return err
+		}
+	}
+
+	versions := globals.RedisClient.Pipeline()
+	for _, op := range done {
+		for _, e := range op.applied {
+			recordAppliedVersionPipeline(ctx, versions, e)
+		}
+	}
+	_, err = versions.Exec(ctx)
+	return err
+}
+
+// BulkIndexHandler serves POST /api/v1/emitted/bulk with newline-delimited
+// indexing events. Every line is validated first; if any is invalid nothing
+// is queued and the report marks the invalid lines with 400. Otherwise the
+// events are queued as by EventHandler and each line reports its stream
+// entry id with 202.
+func BulkIndexHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	start := time.Now()
+	events, report, invalid, err := parseBulkEvents(http.MaxBytesReader(w, r.Body, maxBulkBodyLen))
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(report) == 0 {
+		utils.RespondWithError(w, http.StatusBadRequest, "at least one event is required")
+		return
+	}
+
+	status := http.StatusBadRequest
+	if invalid {
+		for _, be := range events {
+			report[be.result].Status = BulkNotApplied
+		}
+	} else {
+		if err := EnqueueBulkEvents(r.Context(), events, report); err != nil {
+			log.Printf("[BulkIndexHandler] error: %v", err)
+			utils.RespondWithError(w, http.StatusInternalServerError, "Failed to enqueue indexing jobs")
+			return
+		}
+		status = http.StatusAccepted
+	}
+
+	counts := map[string]int{}
+	for _, res := range report {
+		counts[res.Status]++
+	}
+	utils.RespondWithJSON(w, status, BulkIndexResponse{
+		TookMs:  time.Since(start).Milliseconds(),
+		Counts:  counts,
+		Results: report,
+	})
+}
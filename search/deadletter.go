@@ -0,0 +1,242 @@
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"naevis/globals"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/redis/go-redis/v9"
+)
+
+// -------------------------
+// Dead-lettered indexing events
+// -------------------------
+
+// A dead-lettered event is kept in the hash deadLetterKey(id), named after
+// its last stream entry, and listed newest first in deadLetterOrderKey.
+func deadLetterOrderKey() string     { return "indexing:dlq" }
+func deadLetterKey(id string) string { return "indexing:dlq:" + id }
+
+const (
+	defaultDeadLetterLimit = 20
+	maxDeadLetterLimit     = 100
+)
+
+// DeadLetter is an indexing event that failed every attempt. Payload is
+// the event exactly as it was queued.
+type DeadLetter struct {
+	ID       string         `json:"id"`
+	Payload  string         `json:"payload"`
+	Attempts []IndexAttempt `json:"attempts"`
+	DeadAt   time.Time      `json:"dead_at"`
+}
+
+// deadLetterPipeline queues the commands storing e as dead-lettered at now.
+func deadLetterPipeline(ctx context.Context, pipe redis.Pipeliner, e QueuedEvent, now time.Time) error {
+	attempts, err := json.Marshal(e.Attempts)
+	if err != nil {
+		return err
+	}
+	pipe.HSet(ctx, deadLetterKey(e.ID),
+		"payload", e.Event,
+		"attempts", attempts,
+		"dead_at", now.UnixMilli())
+	pipe.ZAdd(ctx, deadLetterOrderKey(), redis.Z{Score: float64(now.UnixMilli()), Member: e.ID})
+	return nil
+}
+
+// DeadLetterIndexEvent dead-letters e without further retries, for events
+// that can never succeed, and acknowledges its entry.
+func DeadLetterIndexEvent(ctx context.Context, e QueuedEvent, cause error) error {
+	now := time.Now().UTC()
+	e.Attempts = append(e.Attempts, IndexAttempt{At: now, Error: cause.Error()})
+	pipe := globals.RedisClient.TxPipeline()
+	if err := deadLetterPipeline(ctx, pipe, e, now); err != nil {
+		return err
+	}
+	pipe.XAck(ctx, IndexingStream, IndexingGroup, e.ID)
+	pipe.XDel(ctx, IndexingStream, e.ID)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func parseDeadLetter(id string, h map[string]string) DeadLetter {
+	d := DeadLetter{ID: id, Payload: h["payload"], Attempts: []IndexAttempt{}}
+	if err := json.Unmarshal([]byte(h["attempts"]), &d.Attempts); err != nil {
+		log.Printf("[parseDeadLetter] id=%s attempts error: %v", id, err)
+	}
+	if ms, err := strconv.ParseInt(h["dead_at"], 10, 64); err == nil {
+		d.DeadAt = time.UnixMilli(ms).UTC()
+	}
+	return d
+}
+
+// ListDeadLetters returns a page of dead-lettered events, newest first, and
+// their total count.
+func ListDeadLetters(ctx context.Context, offset, limit int) ([]DeadLetter, int, error) {
+	total, err := globals.RedisClient.ZCard(ctx, deadLetterOrderKey()).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	ids, err := globals.RedisClient.ZRevRange(ctx, deadLetterOrderKey(), int64(offset), int64(offset+limit-1)).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	out := make([]DeadLetter, 0, len(ids))
+	if len(ids) == 0 {
+		return out, int(total), nil
+	}
+	pipe := globals.RedisClient.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(ids))
+	for i, id := range ids {
+		cmds[i] = pipe.HGetAll(ctx, deadLetterKey(id))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, 0, err
+	}
+	for i, id := range ids {
+		if h := cmds[i].Val(); len(h) > 0 {
+			out = append(out, parseDeadLetter(id, h))
+		}
+	}
+	return out, int(total), nil
+}
+
+// GetDeadLetter returns the dead-lettered event id, if any.
+func GetDeadLetter(ctx context.Context, id string) (DeadLetter, bool, error) {
+	h, err := globals.RedisClient.HGetAll(ctx, deadLetterKey(id)).Result()
+	if err != nil || len(h) == 0 {
+		return DeadLetter{}, false, err
+	}
+	return parseDeadLetter(id, h), true, nil
+}
+
+// replayDeadLetterScript requeues the payload of dead letter ARGV[1] with a
+// fresh attempt count and removes the dead letter, returning the new entry
+// id, or false when there is no such dead letter.
+var replayDeadLetterScript = redis.NewScript(`
+local key = KEYS[1] .. ':' .. ARGV[1]
+local payload = redis.call('HGET', key, 'payload')
+if not payload then
+	return false
+end
+local id = redis.call('XADD', KEYS[2], '*', 'event', payload)
+redis.call('DEL', key)
+redis.call('ZREM', KEYS[1], ARGV[1])
+return id
+`)
+
+// ReplayDeadLetter queues dead letter id again and reports the new stream
+// entry id; found is false when there is no such dead letter.
+func ReplayDeadLetter(ctx context.Context, id string) (string, bool, error) {
+	newID, err := replayDeadLetterScript.Run(ctx, globals.RedisClient,
+		[]string{deadLetterOrderKey(), IndexingStream}, id).Text()
+	if errors.Is(err, redis.Nil) {
+		return "", false, nil
+	}
+	return newID, err == nil, err
+}
+
+// DiscardDeadLetter deletes dead letter id and reports whether it existed.
+func DiscardDeadLetter(ctx context.Context, id string) (bool, error) {
+	pipe := globals.RedisClient.TxPipeline()
+	pipe.Del(ctx, deadLetterKey(id))
+	removed := pipe.ZRem(ctx, deadLetterOrderKey(), id)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, err
+	}
+	return removed.Val() > 0, nil
+}
+
+// -------------------------
+// Admin handlers
+// -------------------------
+
+// ListDeadLettersHandler returns dead-lettered events, newest first, paged
+// with ?offset= and ?limit=.
+func ListDeadLettersHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	q := r.URL.Query()
+	offset, err := queryInt(q, "offset")
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	limit, err := queryInt(q, "limit")
+	if err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if limit == 0 {
+		limit = defaultDeadLetterLimit
+	}
+	limit = min(limit, maxDeadLetterLimit)
+
+	entries, total, err := ListDeadLetters(r.Context(), offset, limit)
+	if err != nil {
+		log.Printf("[ListDeadLettersHandler] error: %v", err)
+		utils.RespondWithError(w, http.StatusInternalServerError, "failed to load dead letters")
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"total":   total,
+		"offset":  offset,
+		"limit":   limit,
+		"entries": entries,
+	})
+}
+
+// GetDeadLetterHandler returns the dead letter :id.
+func GetDeadLetterHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	d, found, err := GetDeadLetter(r.Context(), ps.ByName("id"))
+	if err != nil {
+		log.Printf("[GetDeadLetterHandler] error: %v", err)
+		utils.RespondWithError(w, http.StatusInternalServerError, "failed to load dead letter")
+		return
+	}
+	if !found {
+		utils.RespondWithError(w, http.StatusNotFound, "dead letter not found")
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, d)
+}
+
+// ReplayDeadLetterHandler queues the dead letter :id again.
+func ReplayDeadLetterHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id, found, err := ReplayDeadLetter(r.Context(), ps.ByName("id"))
+	if err != nil {
+		log.Printf("[ReplayDeadLetterHandler] error: %v", err)
+		utils.RespondWithError(w, http.StatusInternalServerError, "failed to replay dead letter")
+		return
+	}
+	if !found {
+		utils.RespondWithError(w, http.StatusNotFound, "dead letter not found")
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusAccepted, map[string]string{
+		"message": "Event queued successfully",
+		"id":      id,
+	})
+}
+
+// DiscardDeadLetterHandler deletes the dead letter :id.
+func DiscardDeadLetterHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	found, err := DiscardDeadLetter(r.Context(), ps.ByName("id"))
+	if err != nil {
+		log.Printf("[DiscardDeadLetterHandler] error: %v", err)
+		utils.RespondWithError(w, http.StatusInternalServerError, "failed to discard dead letter")
+		return
+	}
+	if !found {
+		utils.RespondWithError(w, http.StatusNotFound, "dead letter not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,173 @@
+package search
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// -------------------------
+// Entity details
+// -------------------------
+
+const maxEntityBatch = 100
+
+// EntityResponse is the body of GET /api/v1/entity/:entityType/:id. Entity
+// holds the source document limited to the fields in Projections.
+type EntityResponse struct {
+	Version    string `json:"version"`
+	EntityType string `json:"entity_type"`
+	ID         string `json:"id"`
+	Entity     bson.M `json:"entity"`
+}
+
+// EntityBatchResponse is the body of GET /api/v1/entity/:entityType?ids=.
+// Entities are in the order of the requested ids; Missing lists the ids
+// that were not found.
+type EntityBatchResponse struct {
+	Version    string   `json:"version"`
+	EntityType string   `json:"entity_type"`
+	Entities   []bson.M `json:"entities"`
+	Missing    []string `json:"missing"`
+}
+
+// FetchEntity returns the projected source document of one entity.
+func FetchEntity(ctx context.Context, entityType, id string) (bson.M, error) {
+	var doc bson.M
+	err := FetchAndDecode(ctx, entityType, bson.M{EntityIDFields[entityType]: id}, &doc)
+	return doc, err
+}
+
+// FetchEntities returns the projected source documents of ids in their
+// order, and the ids that were not found.
+func FetchEntities(ctx context.Context, entityType string, ids []string) ([]bson.M, []string, error) {
+	idField := EntityIDFields[entityType]
+	var docs []bson.M
+	if err := FetchAllAndDecode(ctx, entityType, bson.M{idField: bson.M{"$in": ids}}, &docs); err != nil {
+		return nil, nil, err
+	}
+	byID := make(map[string]bson.M, len(docs))
+	for _, d := range docs {
+		if id, ok := d[idField].(string); ok {
+			byID[id] = d
+		}
+	}
+	found := make([]bson.M, 0, len(ids))
+	missing := []string{}
+	for _, id := range ids {
+		if d, ok := byID[id]; ok {
+			found = append(found, d)
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	return found, missing, nil
+}
+
+// detailType validates the :entityType of an entity request.
+func detailType(w http.ResponseWriter, ps httprouter.Params) (string, bool) {
+	entityType := strings.ToLower(ps.ByName("entityType"))
+	if _, ok := EntityIDFields[entityType]; !ok || !contains(searchableTypes, entityType) {
+		writeSearchError(w, http.StatusBadRequest, CodeUnknownEntityType, "Unknown entity type: "+entityType)
+		return "", false
+	}
+	return entityType, true
+}
+
+// EntityHandler serves GET /api/v1/entity/:entityType/:id.
+func EntityHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	entityType, ok := detailType(w, ps)
+	if !ok {
+		return
+	}
+	id := strings.TrimSpace(ps.ByName("id"))
+	doc, err := FetchEntity(r.Context(), entityType, id)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		writeSearchError(w, http.StatusNotFound, CodeNotFound, entityType+" "+id+" not found")
+		return
+	}
+	if err != nil {
+		log.Printf("[EntityHandler] error: %v", err)
+		writeSearchError(w, http.StatusInternalServerError, CodeInternal, "failed to load entity")
+		return
+	}
+	respondWithETag(w, r, EntityResponse{
+		Version:    ResponseVersion,
+		EntityType: entityType,
+		ID:         id,
+		Entity:     doc,
+	})
+}
+
+// EntityBatchHandler serves GET /api/v1/entity/:entityType?ids=a,b,c for
+// up to 100 ids.
+func EntityBatchHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	entityType, ok := detailType(w, ps)
+	if !ok {
+		return
+	}
+	ids := queryList(r.URL.Query()["ids"], strings.TrimSpace)
+	if len(ids) == 0 {
+		writeSearchError(w, http.StatusBadRequest, CodeInvalidParameter, "ids is required")
+		return
+	}
+	if len(ids) > maxEntityBatch {
+		writeSearchError(w, http.StatusBadRequest, CodeInvalidParameter, "at most 100 ids per request")
+		return
+	}
+	docs, missing, err := FetchEntities(r.Context(), entityType, ids)
+	if err != nil {
+		log.Printf("[EntityBatchHandler] error: %v", err)
+		writeSearchError(w, http.StatusInternalServerError, CodeInternal, "failed to load entities")
+		return
+	}
+	respondWithETag(w, r, EntityBatchResponse{
+		Version:    ResponseVersion,
+		EntityType: entityType,
+		Entities:   docs,
+		Missing:    missing,
+	})
+}
+
+// respondWithETag writes body as JSON with an ETag derived from its
+// content, or 304 Not Modified when the client already has it.
+func respondWithETag(w http.ResponseWriter, r *http.Request, body interface{}) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		log.Printf("[respondWithETag] marshal error: %v", err)
+		writeSearchError(w, http.StatusInternalServerError, CodeInternal, "failed to encode response")
+		return
+	}
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(append(data, '\n'))
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, using
+// the weak comparison the header calls for.
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
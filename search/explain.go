@@ -0,0 +1,529 @@
+package search
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"naevis/globals"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/redis/go-redis/v9"
+)
+
+// -------------------------
+// Ranking explanations
+// -------------------------
+
+// Ranking strategies, as chosen by planSearch.
+const (
+	StrategyNone         = "none"
+	StrategyBM25         = "bm25"
+	StrategyBoolean      = "boolean"
+	StrategyHashtagBoost = "hashtag_boost"
+)
+
+// Fixed boosts of the hashtag strategy.
+const (
+	hashtagTokenBoost = 3
+	hashtagTagBoost   = 7
+)
+
+const (
+	defaultExplainLimit = 10
+	maxExplainLimit     = 50
+	maxExplainDropped   = 20
+)
+
+// FieldScore is the contribution of one field to a term's pseudo
+// frequency: Weight * TF, normalised by Length against AvgLength.
+type FieldScore struct {
+	Field        string  `json:"field"`
+	TF           float64 `json:"tf"`
+	Length       float64 `json:"length"`
+	AvgLength    float64 `json:"avg_length"`
+	Weight       float64 `json:"weight"`
+	Contribution float64 `json:"contribution"`
+}
+
+// TermScore is the BM25F score of one term in one document, 0 when the
+// document does not contain it. Unfielded is set for documents indexed
+// without per-field statistics, which count the term once at average
+// length.
+type TermScore struct {
+	Term      string       `json:"term"`
+	DocFreq   int          `json:"doc_freq"`
+	IDF       float64      `json:"idf"`
+	Boost     float64      `json:"boost"`
+	Fields    []FieldScore `json:"fields,omitempty"`
+	Unfielded bool         `json:"unfielded,omitempty"`
+	PseudoTF  float64      `json:"pseudo_tf"`
+	Score     float64      `json:"score"`
+}
+
+// HitExplanation breaks down the rank of one result. Score is the BM25F
+// relevance; under the hashtag strategy it only breaks ties between equal
+// TokenBoost+HashtagBoost, and Recency, the document's position in the
+// first token's posting list, breaks the remaining ones. Unscored marks a
+// result past the score limit, whose Score did not count in its rank.
+type HitExplanation struct {
+	ID           string      `json:"id"`
+	Type         string      `json:"type"`
+	Rank         int         `json:"rank"`
+	Score        float64     `json:"score"`
+	MatchedTerms []string    `json:"matched_terms"`
+	Terms        []TermScore `json:"terms"`
+	TokenBoost   int         `json:"token_boost,omitempty"`
+	HashtagBoost int         `json:"hashtag_boost,omitempty"`
+	Recency      *int        `json:"recency,omitempty"`
+	Created      int64       `json:"created,omitempty"`
+	Unscored     bool        `json:"unscored,omitempty"`
+}
+
+// DroppedCandidate is a document matching some query term that is not in
+// the results, with the reason.
+type DroppedCandidate struct {
+	ID     string `json:"id"`
+	Type   string `json:"type,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// Explanation is the body of GET /api/v1/admin/explain. Tokens are the
+// analysed query terms, Terms the terms scored after expansion with their
+// Boosts, and Postings the posting list size of each. Candidates counts the
+// documents matching any term; DroppedTotal those of them left out of the
+// results, of which Dropped lists a sample. Only the first Scored results
+// were ranked by score: a query matching more than ScoreLimit documents
+// (see maxRankedCandidates) ranks the rest after them unscored.
+type Explanation struct {
+	Query        string             `json:"query"`
+	EntityType   string             `json:"entity_type,omitempty"`
+	Strategy     string             `json:"strategy"`
+	Tokens       []string           `json:"tokens"`
+	Terms        []string           `json:"terms"`
+	Boosts       map[string]float64 `json:"boosts,omitempty"`
+	Postings     map[string]int     `json:"postings"`
+	Candidates   int                `json:"candidates"`
+	Total        int                `json:"total"`
+	Scored       int                `json:"scored"`
+	ScoreLimit   int                `json:"score_limit"`
+	Hits         []HitExplanation   `json:"hits"`
+	Dropped      []DroppedCandidate `json:"dropped"`
+	DroppedTotal int                `json:"dropped_total"`
+}
+
+// ExplainSearch runs query the way the type search endpoint does and
+// explains the first limit results and the candidates it dropped. An empty
+// entityType searches every type.
+func ExplainSearch(ctx context.Context, entityType, query string, limit int) (Explanation, error) {
+	log.Printf("[ExplainSearch] START entityType=%q query=%q limit=%d", entityType, query, limit)
+	out := Explanation{
+		Query:      query,
+		EntityType: entityType,
+		Strategy:   StrategyNone,
+		Tokens:     []string{},
+		Terms:      []string{},
+		Postings:   map[string]int{},
+		Hits:       []HitExplanation{},
+		Dropped:    []DroppedCandidate{},
+	}
+
+	plan, err := planSearch(ctx, entityType, query)
+	if err != nil || plan.node == nil {
+		return out, err
+	}
+	out.Strategy, out.Boosts = plan.strategy, plan.boosts
+	out.Tokens, out.Terms = plan.tokens, plan.terms
+
+	ranked, err := plan.rank(ctx, 0)
+	if err != nil {
+		return out, err
+	}
+	out.Total = len(ranked)
+	out.ScoreLimit = maxRankedCandidates
+	out.Scored = min(out.Total, maxRankedCandidates)
+	kept := newIDSet(ranked)
+
+	postings, err := fetchPostings(ctx, out.Terms)
+	if err != nil {
+		return out, err
+	}
+	for _, t := range out.Terms {
+		out.Postings[t] = len(postings[t])
+	}
+
+	if limit > 0 && len(ranked) > limit {
+		ranked = ranked[:limit]
+	}
+	inTerm := make(map[string]idSet, len(postings))
+	candidates := idSet{}
+	for t, ids := range postings {
+		inTerm[t] = newIDSet(ids)
+		for _, id := range ids {
+			candidates[id] = struct{}{}
+		}
+	}
+	if out.Hits, err = explainHits(ctx, out, ranked, plan.hashtags, postings, inTerm); err != nil {
+		return out, err
+	}
+	out.Candidates = len(candidates)
+	if out.Dropped, out.DroppedTotal, err = explainDropped(ctx, out, plan.node, candidates, kept); err != nil {
+		return out, err
+	}
+	log.Printf("[ExplainSearch] END strategy=%s total=%d dropped=%d", out.Strategy, out.Total, out.DroppedTotal)
+	return out, nil
+}
+
+// fetchPostings returns the posting list of every term, newest first.
+func fetchPostings(ctx context.Context, terms []string) (map[string][]string, error) {
+	out := make(map[string][]string, len(terms))
+	if len(terms) == 0 {
+		return out, nil
+	}
+	pipe := globals.RedisClient.Pipeline()
+	cmds := make([]*redis.StringSliceCmd, len(terms))
+	for i, t := range terms {
+		cmds[i] = pipe.ZRevRange(ctx, invertedKey(t), 0, -1)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+	for i, t := range terms {
+		out[t] = cmds[i].Val()
+	}
+	return out, nil
+}
+
+// explainHits breaks down the rank of ids. postings are the posting lists
+// of the terms, newest first, and inTerm the same as sets.
+func explainHits(ctx context.Context, ex Explanation, ids []string, hashtags []string, postings map[string][]string, inTerm map[string]idSet) ([]HitExplanation, error) {
+	out := make([]HitExplanation, 0, len(ids))
+	if len(ids) == 0 {
+		return out, nil
+	}
+	metas, err := fetchDocMetas(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	docFreqs := make(map[string]int, len(ex.Terms))
+	for _, t := range ex.Terms {
+		docFreqs[t] = ex.Postings[t]
+	}
+	terms := make(map[string][]TermScore, len(ids))
+	scores, err := scoreDocs(ctx, ex.Terms, docFreqs, ex.Boosts, ids, metas, terms)
+	if err != nil {
+		return nil, err
+	}
+
+	// The hashtag strategy counts a document's recency by its position in
+	// the first token's posting list.
+	recency := map[string]int{}
+	if ex.Strategy == StrategyHashtagBoost && len(ex.Tokens) > 0 {
+		for rank, id := range postings[ex.Tokens[0]] {
+			recency[id] = rank
+		}
+	}
+
+	for i, id := range ids {
+		h := HitExplanation{
+			ID:           id,
+			Type:         metas[i]["type"],
+			Rank:         i + 1,
+			Score:        scores[id],
+			MatchedTerms: []string{},
+			Terms:        []TermScore{},
+			Created:      int64(redisFloat(metas[i]["created"], 0)),
+			Unscored:     i >= ex.Scored,
+		}
+		for _, t := range ex.Terms {
+			if _, ok := inTerm[t][id]; ok {
+				h.MatchedTerms = append(h.MatchedTerms, t)
+			}
+		}
+		if terms[id] != nil {
+			h.Terms = terms[id]
+		}
+		if ex.Strategy == StrategyHashtagBoost {
+			h.TokenBoost = hashtagTokenBoost * len(h.MatchedTerms)
+			for _, t := range hashtags {
+				if _, ok := inTerm[t][id]; ok {
+					h.HashtagBoost += hashtagTagBoost
+				}
+			}
+			if r, ok := recency[id]; ok {
+				h.Recency = &r
+			}
+		}
+		out = append(out, h)
+	}
+	return out, nil
+}
+
+// explainDropped gives the reason for leaving out each candidate that is
+// not in kept, for the first maxExplainDropped of them by id.
+func explainDropped(ctx context.Context, ex Explanation, node queryNode, candidates, kept idSet) ([]DroppedCandidate, int, error) {
+	var dropped []string
+	for id := range candidates {
+		if _, ok := kept[id]; !ok {
+			dropped = append(dropped, id)
+		}
+	}
+	sort.Strings(dropped)
+	total := len(dropped)
+	if len(dropped) > maxExplainDropped {
+		dropped = dropped[:maxExplainDropped]
+	}
+	out := make([]DroppedCandidate, 0, len(dropped))
+	if len(dropped) == 0 {
+		return out, total, nil
+	}
+
+	typeOf, err := entityTypes(ctx, dropped)
+	if err != nil {
+		return nil, 0, err
+	}
+	// The tree is evaluated once, against the dropped ids for its type
+	// filters; each id is then explained from the per-clause matches.
+	var tree *nodeMatches
+	if ex.Strategy != StrategyHashtagBoost {
+		ev, err := newQueryEvaluator(ctx, node)
+		if err != nil {
+			return nil, 0, err
+		}
+		if tree, err = ev.matchTree(node, newIDSet(dropped)); err != nil {
+			return nil, 0, err
+		}
+	}
+	for _, id := range dropped {
+		d := DroppedCandidate{ID: id, Type: typeOf[id]}
+		if tree != nil {
+			d.Reason = tree.whyNot(id)
+		}
+		if d.Reason == "" && ex.EntityType != "" && d.Type != ex.EntityType {
+			d.Reason = fmt.Sprintf("type is %q, not %q", d.Type, ex.EntityType)
+		}
+		if d.Reason == "" {
+			d.Reason = "matched but not ranked"
+		}
+		out = append(out, d)
+	}
+	return out, total, nil
+}
+
+// nodeMatches is a query clause with the documents it matches and the
+// matches of its sub-clauses. A phrase keeps the postings of its terms.
+type nodeMatches struct {
+	node     queryNode
+	set      idSet
+	children []*nodeMatches
+	terms    []idSet
+}
+
+// matchTree works out which of the ids in within each clause of node
+// matches, evaluating every clause once.
+func (ev *queryEvaluator) matchTree(node queryNode, within idSet) (*nodeMatches, error) {
+	m := &nodeMatches{node: node, set: idSet{}}
+	var err error
+	switch n := node.(type) {
+	case termNode:
+		m.set = within.intersect(ev.postings[postingKey(n.field, n.term)])
+	case typeNode:
+		m.set, err = ev.ofTypes(within, n)
+	case phraseNode:
+		set := within
+		for i, t := range n.phrase.terms {
+			if !n.phrase.isStop(i) {
+				p := ev.postings[postingKey(n.field, t)]
+				m.terms = append(m.terms, p)
+				set = set.intersect(p)
+			}
+		}
+		fields := indexedFields
+		if n.field != "" {
+			fields = []string{n.field}
+		}
+		var ids []string
+		if ids, err = filterPhraseMatches(ev.ctx, n.phrase, fields, set.list()); err == nil {
+			m.set = newIDSet(ids)
+		}
+	case orNode:
+		if isTypeFilter(n) {
+			m.set, err = ev.ofTypes(within, n)
+			break
+		}
+		if m.children, err = ev.matchChildren(n.children, within); err == nil {
+			for _, c := range m.children {
+				m.set = m.set.union(c.set)
+			}
+		}
+	case notNode:
+		// A NOT only counts inside the AND holding it; its set is the
+		// matches of its child.
+		if m.children, err = ev.matchChildren([]queryNode{n.child}, within); err == nil {
+			m.set = m.children[0].set
+		}
+	case andNode:
+		if m.children, err = ev.matchChildren(n.children, within); err != nil {
+			break
+		}
+		m.set = within
+		for _, c := range m.children {
+			if _, ok := c.node.(notNode); ok {
+				m.set = m.set.minus(c.set)
+			} else {
+				m.set = m.set.intersect(c.set)
+			}
+		}
+	default:
+		err = fmt.Errorf("unknown query node %T", node)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (ev *queryEvaluator) matchChildren(nodes []queryNode, within idSet) ([]*nodeMatches, error) {
+	out := make([]*nodeMatches, len(nodes))
+	for i, c := range nodes {
+		m, err := ev.matchTree(c, within)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = m
+	}
+	return out, nil
+}
+
+// whyNot explains why the clause does not match id, or returns "" when it
+// does.
+func (m *nodeMatches) whyNot(id string) string {
+	if _, ok := m.set[id]; ok {
+		return ""
+	}
+	switch n := m.node.(type) {
+	case termNode:
+		return "missing " + describeNode(n)
+	case phraseNode:
+		var missing []string
+		i := 0
+		for j, t := range n.phrase.terms {
+			if n.phrase.isStop(j) {
+				continue
+			}
+			if _, ok := m.terms[i][id]; !ok {
+				missing = append(missing, t)
+			}
+			i++
+		}
+		if len(missing) > 0 {
+			return fmt.Sprintf("missing %s of %s", strings.Join(missing, ", "), describeNode(n))
+		}
+		return "terms of " + describeNode(n) + " are not close enough"
+	case andNode:
+		var reasons []string
+		for _, c := range m.children {
+			if not, ok := c.node.(notNode); ok {
+				if _, ok := c.set[id]; ok {
+					reasons = append(reasons, "excluded by "+describeNode(not))
+				}
+				continue
+			}
+			if isTypeFilter(c.node) {
+				if _, ok := c.set[id]; !ok {
+					reasons = append(reasons, "not of "+describeNode(c.node))
+				}
+				continue
+			}
+			if r := c.whyNot(id); r != "" {
+				reasons = append(reasons, r)
+			}
+		}
+		return strings.Join(reasons, "; ")
+	case orNode:
+		return "matches none of " + describeNode(n)
+	case typeNode:
+		return "not of " + describeNode(n)
+	case notNode:
+		return "excluded by " + describeNode(n)
+	}
+	return ""
+}
+
+// describeNode renders node in query syntax.
+func describeNode(node queryNode) string {
+	prefix := func(field string) string {
+		if field == "" {
+			return ""
+		}
+		return field + ":"
+	}
+	switch n := node.(type) {
+	case termNode:
+		return prefix(n.field) + n.term
+	case typeNode:
+		return "type:" + n.entityType
+	case phraseNode:
+		s := prefix(n.field) + `"` + strings.Join(n.phrase.terms, " ") + `"`
+		if n.phrase.slop > 0 {
+			s += fmt.Sprintf("~%d", n.phrase.slop)
+		}
+		return s
+	case andNode:
+		parts := make([]string, len(n.children))
+		for i, c := range n.children {
+			parts[i] = describeNode(c)
+		}
+		return "(" + strings.Join(parts, " ") + ")"
+	case orNode:
+		parts := make([]string, len(n.children))
+		for i, c := range n.children {
+			parts[i] = describeNode(c)
+		}
+		return "(" + strings.Join(parts, " OR ") + ")"
+	case notNode:
+		return "-" + describeNode(n.child)
+	}
+	return fmt.Sprintf("%v", node)
+}
+
+// ExplainHandler serves GET /api/v1/admin/explain?q=...&type=songs&limit=10.
+func ExplainHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	q := r.URL.Query()
+	query := strings.TrimSpace(q.Get("q"))
+	if query == "" {
+		writeSearchError(w, http.StatusBadRequest, CodeMissingQuery, "Search query is required")
+		return
+	}
+	entityType := strings.ToLower(strings.TrimSpace(q.Get("type")))
+	if entityType != "" && !contains(searchableTypes, entityType) {
+		writeSearchError(w, http.StatusBadRequest, CodeUnknownEntityType, "Unknown entity type: "+entityType)
+		return
+	}
+	limit, err := queryInt(q, "limit")
+	if err != nil {
+		writeSearchError(w, http.StatusBadRequest, CodeInvalidParameter, err.Error())
+		return
+	}
+	if limit == 0 {
+		limit = defaultExplainLimit
+	}
+	limit = min(limit, maxExplainLimit)
+
+	ex, err := ExplainSearch(r.Context(), entityType, query, limit)
+	if err != nil {
+		if errors.Is(err, ErrInvalidQuery) {
+			writeSearchError(w, http.StatusBadRequest, CodeInvalidQuery, err.Error())
+			return
+		}
+		log.Printf("[ExplainHandler] error: %v", err)
+		writeSearchError(w, http.StatusInternalServerError, CodeInternal, "failed to explain search")
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, ex)
+}
@@ -0,0 +1,142 @@
+package search
+
+import (
+	"sort"
+	"strings"
+)
+
+// -------------------------
+// Facets
+// -------------------------
+
+// Facetable attributes. The type facet comes from Entity.EntityType; the
+// rest are read from Entity.Facets.
+const (
+	FacetType        = "type"
+	FacetCategory    = "category"
+	FacetSubcategory = "subcategory"
+	FacetTags        = "tags"
+	FacetGenre       = "genre"
+	FacetCity        = "city"
+)
+
+var facetNames = []string{FacetType, FacetCategory, FacetSubcategory, FacetTags, FacetGenre, FacetCity}
+
+// maxFacetValues caps the values returned per facet, most frequent first.
+const maxFacetValues = 20
+
+// facetValueSep joins the values of one facet in docmeta.
+const facetValueSep = "\x1f"
+
+// FacetValue is one value of a facet and the number of matches having it.
+type FacetValue struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// Facet holds the value counts of one facetable attribute.
+type Facet struct {
+	Name   string       `json:"name"`
+	Values []FacetValue `json:"values"`
+}
+
+// newFacets drops blank and repeated values and facets left without any.
+func newFacets(in map[string][]string) map[string][]string {
+	out := map[string][]string{}
+	for name, values := range in {
+		seen := map[string]bool{}
+		for _, v := range values {
+			v = strings.TrimSpace(v)
+			if k := strings.ToLower(v); v != "" && !seen[k] {
+				seen[k] = true
+				out[name] = append(out[name], v)
+			}
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+func facetMetaField(name string) string { return "facet:" + name }
+
+// facetMeta returns the docmeta entries recording the facets of e.
+func facetMeta(e Entity) map[string]interface{} {
+	out := make(map[string]interface{}, len(e.Facets))
+	for name, values := range e.Facets {
+		if name != FacetType && len(values) > 0 {
+			out[facetMetaField(name)] = strings.Join(values, facetValueSep)
+		}
+	}
+	return out
+}
+
+// docFacetValues reads the values of facet name from a docmeta hash.
+func docFacetValues(meta map[string]string, name string) []string {
+	if name == FacetType {
+		if t := meta["type"]; t != "" {
+			return []string{t}
+		}
+		return nil
+	}
+	if v := meta[facetMetaField(name)]; v != "" {
+		return strings.Split(v, facetValueSep)
+	}
+	return nil
+}
+
+// matchesFacets reports whether a document passes every facet filter
+// except the one on skip.
+func matchesFacets(meta map[string]string, filters map[string][]string, skip string) bool {
+	for name, want := range filters {
+		if name == skip {
+			continue
+		}
+		found := false
+		for _, v := range docFacetValues(meta, name) {
+			for _, w := range want {
+				if strings.EqualFold(v, w) {
+					found = true
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// countFacet counts the values of facet name over the documents passing the
+// facet filters other than its own. Nil metas were filtered out already.
+func countFacet(name string, metas []map[string]string, filters map[string][]string) Facet {
+	counts := map[string]int{}
+	labels := map[string]string{}
+	for _, meta := range metas {
+		if meta == nil || !matchesFacets(meta, filters, name) {
+			continue
+		}
+		for _, v := range docFacetValues(meta, name) {
+			k := strings.ToLower(v)
+			if _, ok := labels[k]; !ok {
+				labels[k] = v
+			}
+			counts[k]++
+		}
+	}
+	f := Facet{Name: name, Values: make([]FacetValue, 0, len(counts))}
+	for k, n := range counts {
+		f.Values = append(f.Values, FacetValue{Value: labels[k], Count: n})
+	}
+	sort.Slice(f.Values, func(i, j int) bool {
+		if f.Values[i].Count != f.Values[j].Count {
+			return f.Values[i].Count > f.Values[j].Count
+		}
+		return f.Values[i].Value < f.Values[j].Value
+	})
+	if len(f.Values) > maxFacetValues {
+		f.Values = f.Values[:maxFacetValues]
+	}
+	return f
+}
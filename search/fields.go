@@ -0,0 +1,204 @@
+package search
+
+import (
+	"strings"
+)
+
+// -------------------------
+// Indexed fields and weights
+// -------------------------
+
+// Searchable fields every entity is broken down into. Title and Description
+// come from the Entity itself; the rest are read from Entity.Fields.
+const (
+	FieldTitle       = "title"
+	FieldDescription = "description"
+	FieldTags        = "tags"
+	FieldCategory    = "category"
+)
+
+var indexedFields = []string{FieldTitle, FieldDescription, FieldTags, FieldCategory}
+
+// defaultFieldWeights is used for entity types without their own entry in
+// fieldWeights.
+var defaultFieldWeights = map[string]float64{
+	FieldTitle:       3,
+	FieldDescription: 1,
+	FieldTags:        2,
+	FieldCategory:    1.5,
+}
+
+// fieldWeights boosts each field per entity type. Names of people and
+// products should dominate; long free text such as blog bodies is damped.
+var fieldWeights = map[string]map[string]float64{
+	"artists":      {FieldTitle: 5, FieldDescription: 0.8, FieldTags: 2, FieldCategory: 1.5},
+	"users":        {FieldTitle: 5, FieldDescription: 0.8},
+	"products":     {FieldTitle: 5, FieldDescription: 1, FieldTags: 2, FieldCategory: 2},
+	"merch":        {FieldTitle: 5, FieldDescription: 1, FieldTags: 2},
+	"crops":        {FieldTitle: 5, FieldDescription: 1.5},
+	"songs":        {FieldTitle: 4, FieldDescription: 1, FieldCategory: 1.5},
+	"blogposts":    {FieldTitle: 3, FieldDescription: 0.5, FieldCategory: 1.5},
+	"feedposts":    {FieldTitle: 1, FieldDescription: 0.5},
+	"baitos":       {FieldTitle: 3, FieldDescription: 1, FieldCategory: 2},
+	"baitoworkers": {FieldTitle: 3, FieldDescription: 1, FieldTags: 2},
+}
+
+// weightsFor returns the field weights for an entity type.
+func weightsFor(entityType string) map[string]float64 {
+	if w, ok := fieldWeights[entityType]; ok {
+		return w
+	}
+	return defaultFieldWeights
+}
+
+// entityFieldText returns the text of every searchable field of e, keyed by
+// field name. Empty fields are left out.
+func entityFieldText(e Entity) map[string]string {
+	out := make(map[string]string, len(indexedFields))
+	if e.Title != "" {
+		out[FieldTitle] = e.Title
+	}
+	if e.Description != "" {
+		out[FieldDescription] = e.Description
+	}
+	for f, text := range e.Fields {
+		if f == FieldTitle || f == FieldDescription || strings.TrimSpace(text) == "" {
+			continue
+		}
+		out[f] = text
+	}
+	return out
+}
+
+// joinField flattens list-valued source attributes (tags, genres) into field
+// text.
+func joinField(values ...string) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			parts = append(parts, v)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// -------------------------
+// Per-document term statistics
+// -------------------------
+
+// docTerms is the analysed form of an entity: term frequencies, positions
+// and lengths per field, the positions of stop words per field, plus the set
+// of tokens found in any field and the subset that appear as written, which
+// feed autocomplete.
+type docTerms struct {
+	fieldTF      map[string]map[string]int
+	fieldPos     map[string]map[string][]int
+	fieldStopPos map[string]map[string][]int
+	fieldLen     map[string]int
+	tokens       map[string]struct{}
+	words        map[string]struct{}
+	length       int
+}
+
+func entityTerms(e Entity) docTerms {
+	return entityTermsWith(e, analyzerFor(e.EntityType, e.Language))
+}
+
+// entityTermsWith analyses e with a instead of the entity's own analyzer.
+func entityTermsWith(e Entity, a *Analyzer) docTerms {
+	dt := docTerms{
+		fieldTF:      map[string]map[string]int{},
+		fieldPos:     map[string]map[string][]int{},
+		fieldStopPos: map[string]map[string][]int{},
+		fieldLen:     map[string]int{},
+		tokens:       map[string]struct{}{},
+		words:        map[string]struct{}{},
+	}
+	for f, text := range entityFieldText(e) {
+		ft := termPositions(a, text)
+		if len(ft.stopPos) > 0 {
+			dt.fieldStopPos[f] = ft.stopPos
+		}
+		if ft.length == 0 {
+			continue
+		}
+		for _, w := range ft.words {
+			dt.words[w] = struct{}{}
+		}
+		tf := make(map[string]int, len(ft.pos))
+		for t, p := range ft.pos {
+			tf[t] = len(p)
+			dt.tokens[t] = struct{}{}
+		}
+		dt.fieldTF[f] = tf
+		dt.fieldPos[f] = ft.pos
+		dt.fieldLen[f] = ft.length
+		dt.length += ft.length
+	}
+	return dt
+}
+
+// tokenList returns the distinct tokens of the document.
+func (dt docTerms) tokenList() []string {
+	out := make([]string, 0, len(dt.tokens))
+	for t := range dt.tokens {
+		out = append(out, t)
+	}
+	return out
+}
+
+// termMembers lists the postings of the document in the form docTermsKey
+// stores them.
+func (dt docTerms) termMembers() []string {
+	var out []string
+	for field, tf := range dt.fieldTF {
+		for token := range tf {
+			out = append(out, "t:"+field+":"+token)
+		}
+	}
+	for field, stops := range dt.fieldStopPos {
+		for word := range stops {
+			out = append(out, "s:"+field+":"+word)
+		}
+	}
+	return out
+}
+
+// parseDocTerms rebuilds the postings of a document from its docTermsKey
+// members. Only the keys are known, so frequencies and positions are left
+// empty; the result is good for unindexDocPipeline and nothing else.
+func parseDocTerms(members []string) docTerms {
+	dt := docTerms{
+		fieldTF:      map[string]map[string]int{},
+		fieldStopPos: map[string]map[string][]int{},
+		tokens:       map[string]struct{}{},
+	}
+	for _, m := range members {
+		parts := strings.SplitN(m, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		switch parts[0] {
+		case "t":
+			dt.addTerm(parts[1], parts[2])
+		case "s":
+			dt.addStopWord(parts[1], parts[2])
+		}
+	}
+	return dt
+}
+
+func (dt *docTerms) addTerm(field, token string) {
+	if dt.fieldTF[field] == nil {
+		dt.fieldTF[field] = map[string]int{}
+	}
+	dt.fieldTF[field][token] = 0
+	dt.tokens[token] = struct{}{}
+}
+
+func (dt *docTerms) addStopWord(field, word string) {
+	if dt.fieldStopPos[field] == nil {
+		dt.fieldStopPos[field] = map[string][]int{}
+	}
+	dt.fieldStopPos[field][word] = nil
+}
@@ -0,0 +1,197 @@
+package search
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// -------------------------
+// Attribute filters
+// -------------------------
+
+// Stock statuses derived by ConvertToEntity. Sources with a free-form
+// status are normalised with normalizeStatus and kept as written.
+const (
+	StatusInStock    = "in_stock"
+	StatusOutOfStock = "out_of_stock"
+)
+
+// AttributeFilters restricts matches by the typed attributes of Entity. An
+// empty filter is not applied. Category matches the category facet and,
+// like Status, any of its values; bounds are inclusive.
+type AttributeFilters struct {
+	Category      []string
+	Status        []string
+	PriceMin      *float64
+	PriceMax      *float64
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+}
+
+func (f AttributeFilters) empty() bool {
+	return len(f.Category) == 0 && len(f.Status) == 0 && f.PriceMin == nil && f.PriceMax == nil &&
+		f.CreatedAfter.IsZero() && f.CreatedBefore.IsZero()
+}
+
+// normalizeStatus turns "In Stock" and "in-stock" into in_stock.
+func normalizeStatus(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	return strings.NewReplacer(" ", "_", "-", "_").Replace(s)
+}
+
+// stockStatus returns in_stock or out_of_stock for an available quantity.
+func stockStatus[N int | float64](n N) string {
+	if n > 0 {
+		return StatusInStock
+	}
+	return StatusOutOfStock
+}
+
+// attributeMeta returns the docmeta entries recording the filter attributes
+// and sort keys of e.
+func attributeMeta(e Entity) map[string]interface{} {
+	out := map[string]interface{}{}
+	if e.Price != nil {
+		out["price"] = strconv.FormatFloat(*e.Price, 'f', -1, 64)
+	}
+	if e.Status != "" {
+		out["status"] = e.Status
+	}
+	if e.Popularity != 0 {
+		out["popularity"] = e.Popularity
+	}
+	if e.Rating != nil {
+		out["rating"] = strconv.FormatFloat(*e.Rating, 'f', -1, 64)
+	}
+	if e.Wage != nil {
+		out["wage"] = strconv.FormatFloat(*e.Wage, 'f', -1, 64)
+	}
+	if e.Date != nil {
+		out["date"] = e.Date.UnixNano()
+	}
+	return out
+}
+
+// matches reports whether a document's docmeta passes f. A document
+// without the filtered attribute does not.
+func (f AttributeFilters) matches(meta map[string]string) bool {
+	if len(f.Category) > 0 && !matchesFacets(meta, map[string][]string{FacetCategory: f.Category}, "") {
+		return false
+	}
+	if len(f.Status) > 0 && !contains(f.Status, meta["status"]) {
+		return false
+	}
+	if f.PriceMin != nil || f.PriceMax != nil {
+		price, err := strconv.ParseFloat(meta["price"], 64)
+		if err != nil || (f.PriceMin != nil && price < *f.PriceMin) || (f.PriceMax != nil && price > *f.PriceMax) {
+			return false
+		}
+	}
+	if !f.CreatedAfter.IsZero() || !f.CreatedBefore.IsZero() {
+		ns, err := strconv.ParseInt(meta["created"], 10, 64)
+		if err != nil {
+			return false
+		}
+		created := time.Unix(0, ns)
+		if (!f.CreatedAfter.IsZero() && created.Before(f.CreatedAfter)) ||
+			(!f.CreatedBefore.IsZero() && created.After(f.CreatedBefore)) {
+			return false
+		}
+	}
+	return true
+}
+
+// attributeFilters reads category=, status=, price_min=, price_max=,
+// created_after= and created_before=. Lists are repeatable or
+// comma-separated; dates are RFC 3339 or YYYY-MM-DD.
+func attributeFilters(q url.Values) (AttributeFilters, error) {
+	var f AttributeFilters
+	f.Category = queryList(q["category"], strings.TrimSpace)
+	f.Status = queryList(q["status"], normalizeStatus)
+
+	var err error
+	if f.PriceMin, err = queryFloat(q.Get("price_min"), "price_min"); err != nil {
+		return f, err
+	}
+	if f.PriceMax, err = queryFloat(q.Get("price_max"), "price_max"); err != nil {
+		return f, err
+	}
+	if f.PriceMin != nil && f.PriceMax != nil && *f.PriceMin > *f.PriceMax {
+		return f, errors.New("price_min must not exceed price_max")
+	}
+	if f.CreatedAfter, err = queryTime(q.Get("created_after"), "created_after", false); err != nil {
+		return f, err
+	}
+	if f.CreatedBefore, err = queryTime(q.Get("created_before"), "created_before", true); err != nil {
+		return f, err
+	}
+	return f, nil
+}
+
+func queryList(values []string, clean func(string) string) []string {
+	var out []string
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			if part = clean(part); part != "" && !contains(out, part) {
+				out = append(out, part)
+			}
+		}
+	}
+	return out
+}
+
+func queryFloat(v, name string) (*float64, error) {
+	if v == "" {
+		return nil, nil
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("%s must be a non-negative number", name)
+	}
+	return &n, nil
+}
+
+// queryTime parses an RFC 3339 time or a date; a date given as an upper
+// bound covers the whole day.
+func queryTime(v, name string, endOfDay bool) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.DateOnly, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be an RFC 3339 time or YYYY-MM-DD", name)
+	}
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Nanosecond)
+	}
+	return t, nil
+}
+
+// describe records f in the response envelope's filters.
+func (f AttributeFilters) describe(filters map[string]string) {
+	if len(f.Category) > 0 {
+		filters["category"] = strings.Join(f.Category, ",")
+	}
+	if len(f.Status) > 0 {
+		filters["status"] = strings.Join(f.Status, ",")
+	}
+	if f.PriceMin != nil {
+		filters["price_min"] = strconv.FormatFloat(*f.PriceMin, 'f', -1, 64)
+	}
+	if f.PriceMax != nil {
+		filters["price_max"] = strconv.FormatFloat(*f.PriceMax, 'f', -1, 64)
+	}
+	if !f.CreatedAfter.IsZero() {
+		filters["created_after"] = f.CreatedAfter.Format(time.RFC3339)
+	}
+	if !f.CreatedBefore.IsZero() {
+		filters["created_before"] = f.CreatedBefore.Format(time.RFC3339)
+	}
+}
@@ -0,0 +1,274 @@
+package search
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"naevis/globals"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// -------------------------
+// Fuzzy (typo-tolerant) matching
+// -------------------------
+
+const (
+	// Terms with fewer postings than this are expanded.
+	fuzzyMinDocFreq = 3
+	// At most this many vocabulary terms are added per query term.
+	fuzzyMaxExpansions = 5
+	// Upper bound on vocabulary entries examined per query term.
+	fuzzyScanLimit = 5000
+	// A fuzzy match scores fuzzyWeight^edits of an exact one.
+	fuzzyWeight = 0.5
+)
+
+// fuzzyMaxEdits is the edit budget for a term, by length in runes: none up
+// to 2, one up to 5, two beyond.
+func fuzzyMaxEdits(term string) int {
+	switch n := utf8.RuneCountInString(term); {
+	case n <= 2:
+		return 0
+	case n <= 5:
+		return 1
+	}
+	return 2
+}
+
+// editDistance is the optimal string alignment distance between a and b:
+// insertions, deletions, substitutions and transpositions of adjacent runes
+// each cost one, which covers most keyboard slips. It stops early and
+// returns max+1 once the distance must exceed max.
+func editDistance(a, b string, max int) int {
+	ra, rb := []rune(a), []rune(b)
+	if d := len(ra) - len(rb); d > max || -d > max {
+		return max + 1
+	}
+
+	prev2 := make([]int, len(rb)+1)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+			rowMin = min(rowMin, cur[j])
+		}
+		if rowMin > max {
+			return max + 1
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	if prev[len(rb)] > max {
+		return max + 1
+	}
+	return prev[len(rb)]
+}
+
+// fuzzyEligible reports whether term may be expanded. Hashtags are meant
+// literally and CJK bigrams are too short to correct.
+func fuzzyEligible(term string) bool {
+	if strings.HasPrefix(term, "#") || fuzzyMaxEdits(term) == 0 {
+		return false
+	}
+	for _, r := range term {
+		if isCJK(r) {
+			return false
+		}
+	}
+	return true
+}
+
+type fuzzyMatch struct {
+	term    string
+	edits   int
+	docFreq int64
+}
+
+// fuzzyCandidates returns, for each term, the indexed vocabulary words within
+// its edit budget, closest and most frequent first. The vocabulary is the
+// autocomplete set; candidates must share the term's first letter, which
+// keeps the scan to one lexical range and is where typos are rarest.
+func fuzzyCandidates(ctx context.Context, terms []string) (map[string][]fuzzyMatch, error) {
+	out := make(map[string][]fuzzyMatch, len(terms))
+	if len(terms) == 0 {
+		return out, nil
+	}
+
+	pipe := globals.RedisClient.Pipeline()
+	scans := make([]*redis.StringSliceCmd, len(terms))
+	for i, t := range terms {
+		r, _ := utf8.DecodeRuneInString(t)
+		first := string(r)
+		scans[i] = pipe.ZRangeByLex(ctx, autocompleteZSet(), &redis.ZRangeBy{
+			Min:   "[" + first,
+			Max:   "[" + first + "\xff",
+			Count: fuzzyScanLimit,
+		})
+	}
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+
+	// Words stay in the vocabulary after their documents are deleted, so
+	// every candidate's posting list is checked before it is used.
+	pipe = globals.RedisClient.Pipeline()
+	cards := map[string]*redis.IntCmd{}
+	for i, t := range terms {
+		max := fuzzyMaxEdits(t)
+		for _, w := range scans[i].Val() {
+			if w == t {
+				continue
+			}
+			if d := editDistance(t, w, max); d <= max {
+				out[t] = append(out[t], fuzzyMatch{term: w, edits: d})
+				if _, ok := cards[w]; !ok {
+					cards[w] = pipe.ZCard(ctx, invertedKey(w))
+				}
+			}
+		}
+	}
+	if len(cards) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	for t, ms := range out {
+		kept := ms[:0]
+		for _, m := range ms {
+			if m.docFreq = cards[m.term].Val(); m.docFreq > 0 {
+				kept = append(kept, m)
+			}
+		}
+		sort.Slice(kept, func(i, j int) bool {
+			if kept[i].edits != kept[j].edits {
+				return kept[i].edits < kept[j].edits
+			}
+			if kept[i].docFreq != kept[j].docFreq {
+				return kept[i].docFreq > kept[j].docFreq
+			}
+			return kept[i].term < kept[j].term
+		})
+		if len(kept) > fuzzyMaxExpansions {
+			kept = kept[:fuzzyMaxExpansions]
+		}
+		out[t] = kept
+	}
+	return out, nil
+}
+
+// expandFuzzy rewrites every unqualified, non-excluded term of node that is
+// among only and has fewer than fuzzyMinDocFreq postings into an OR of the
+// term and its fuzzy matches. It returns the new tree and the score boost of
+// each added term.
+func expandFuzzy(ctx context.Context, node queryNode, only []string) (queryNode, map[string]float64, error) {
+	var terms []string
+	seen := map[string]bool{}
+	collectFuzzyTerms(node, seen, &terms)
+	kept := terms[:0]
+	for _, t := range terms {
+		if contains(only, t) {
+			kept = append(kept, t)
+		}
+	}
+	terms = kept
+	if len(terms) == 0 {
+		return node, nil, nil
+	}
+
+	docFreqs, err := documentFrequencies(ctx, terms)
+	if err != nil {
+		return nil, nil, err
+	}
+	var rare []string
+	for _, t := range terms {
+		if docFreqs[t] < fuzzyMinDocFreq {
+			rare = append(rare, t)
+		}
+	}
+	if len(rare) == 0 {
+		return node, nil, nil
+	}
+
+	matches, err := fuzzyCandidates(ctx, rare)
+	if err != nil {
+		return nil, nil, err
+	}
+	boosts := map[string]float64{}
+	for _, ms := range matches {
+		for _, m := range ms {
+			boosts[m.term] = math.Max(boosts[m.term], math.Pow(fuzzyWeight, float64(m.edits)))
+		}
+	}
+	if len(boosts) == 0 {
+		log.Printf("[expandFuzzy] No fuzzy matches for %v", rare)
+		return node, nil, nil
+	}
+	log.Printf("[expandFuzzy] rare=%v boosts=%v", rare, boosts)
+	return rewriteFuzzy(node, matches), boosts, nil
+}
+
+// collectFuzzyTerms lists the terms expandFuzzy may rewrite.
+func collectFuzzyTerms(node queryNode, seen map[string]bool, out *[]string) {
+	switch n := node.(type) {
+	case termNode:
+		if n.field == "" && !seen[n.term] && fuzzyEligible(n.term) {
+			seen[n.term] = true
+			*out = append(*out, n.term)
+		}
+	case andNode:
+		for _, c := range n.children {
+			collectFuzzyTerms(c, seen, out)
+		}
+	case orNode:
+		for _, c := range n.children {
+			collectFuzzyTerms(c, seen, out)
+		}
+	}
+}
+
+func rewriteFuzzy(node queryNode, matches map[string][]fuzzyMatch) queryNode {
+	switch n := node.(type) {
+	case termNode:
+		ms := matches[n.term]
+		if n.field != "" || len(ms) == 0 {
+			return n
+		}
+		or := orNode{children: []queryNode{n}}
+		for _, m := range ms {
+			or.children = append(or.children, termNode{term: m.term})
+		}
+		return or
+	case andNode:
+		out := andNode{children: make([]queryNode, len(n.children))}
+		for i, c := range n.children {
+			out.children[i] = rewriteFuzzy(c, matches)
+		}
+		return out
+	case orNode:
+		out := orNode{children: make([]queryNode, len(n.children))}
+		for i, c := range n.children {
+			out.children[i] = rewriteFuzzy(c, matches)
+		}
+		return out
+	}
+	return node
+}
@@ -0,0 +1,57 @@
+package search
+
+import "testing"
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		max  int
+		want int
+	}{
+		{"farm", "farm", 2, 0},
+		{"", "", 2, 0},
+		{"", "ab", 2, 2},
+		// One insertion, deletion or substitution.
+		{"farm", "farms", 2, 1},
+		{"farms", "farm", 2, 1},
+		{"farm", "form", 2, 1},
+		// An adjacent transposition costs one, not two.
+		{"tomato", "tomaot", 2, 1},
+		{"recieve", "receive", 2, 1},
+		{"ab", "ba", 2, 1},
+		{"abcd", "badc", 2, 2},
+		// Optimal string alignment does not edit a transposed pair again.
+		{"ca", "abc", 3, 3},
+		// Distances are counted in runes.
+		{"café", "cafe", 2, 1},
+		{"東京", "京東", 2, 1},
+		// Past max the result is max+1.
+		{"farm", "fjords", 1, 2},
+		{"kitten", "sitting", 2, 3},
+		{"kitten", "sitting", 3, 3},
+		{"a", "abcd", 2, 3},
+	}
+	for _, tt := range tests {
+		if got := editDistance(tt.a, tt.b, tt.max); got != tt.want {
+			t.Errorf("editDistance(%q, %q, %d) = %d, want %d", tt.a, tt.b, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestFuzzyEligible(t *testing.T) {
+	tests := []struct {
+		term string
+		want bool
+	}{
+		{"to", false},
+		{"farm", true},
+		{"#farms", false},
+		{"東京タワー", false},
+		{"tomatoes", true},
+	}
+	for _, tt := range tests {
+		if got := fuzzyEligible(tt.term); got != tt.want {
+			t.Errorf("fuzzyEligible(%q) = %v, want %v", tt.term, got, tt.want)
+		}
+	}
+}
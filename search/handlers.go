@@ -1,18 +1,25 @@
 package search
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
-	"naevis/globals"
 	"naevis/models"
+	"naevis/utils"
 
 	"github.com/julienschmidt/httprouter"
 )
 
+// EventHandler queues an indexing event and answers 202 once it is stored
+// in the indexing stream.
 func EventHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	log.Printf("[EventHandler] START method=%s", r.Method)
 
@@ -35,14 +42,18 @@ func EventHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		return
 	}
 
-	if err := globals.RedisClient.Publish(r.Context(), "indexing-events", string(body)).Err(); err != nil {
+	id, err := EnqueueIndexEvent(r.Context(), body)
+	if err != nil {
+		log.Printf("[EventHandler] enqueue error: %v", err)
 		http.Error(w, "Failed to enqueue indexing job", http.StatusInternalServerError)
 		return
 	}
+	log.Printf("[EventHandler] queued id=%s event=%+v", id, event)
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusAccepted)
-	_, _ = w.Write([]byte(`{"message":"Event queued successfully"}`))
+	utils.RespondWithJSON(w, http.StatusAccepted, map[string]string{
+		"message": "Event queued successfully",
+		"id":      id,
+	})
 }
 
 func SearchHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
@@ -50,30 +61,151 @@ func SearchHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	start := time.Now()
 
-	entityType := ps.ByName("entityType")
-	query := strings.TrimSpace(r.URL.Query().Get("q"))
-	if query == "" {
-		query = strings.TrimSpace(r.URL.Query().Get("query"))
+	s, serr := parseTypeSearch(ps.ByName("entityType"), r.URL.Query())
+	if serr != nil {
+		writeSearchError(w, serr.status, serr.code, serr.message)
+		return
 	}
-	if query == "" {
-		http.Error(w, "Search query is required", http.StatusBadRequest)
+	res, serr := runTypeSearch(r.Context(), s, start)
+	if serr != nil {
+		writeSearchError(w, serr.status, serr.code, serr.message)
 		return
 	}
+	utils.RespondWithJSON(w, http.StatusOK, res)
+}
+
+// typeSearch is a parsed search of one entity type.
+type typeSearch struct {
+	entityType  string
+	query       string
+	cursor      string
+	offset      int
+	limit       int
+	options     SearchOptions
+	highlight   *HighlightOptions // nil disables highlighting
+	autocorrect bool
+}
+
+// searchError is a failed search as reported in the error envelope.
+type searchError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *searchError) Error() string { return e.code + ": " + e.message }
+
+func badSearch(code, message string) *searchError {
+	return &searchError{status: http.StatusBadRequest, code: code, message: message}
+}
+
+// parseTypeSearch reads a search of entityType from its query parameters.
+func parseTypeSearch(entityType string, q url.Values) (typeSearch, *searchError) {
+	s := typeSearch{entityType: entityType, cursor: q.Get("cursor")}
+	s.query = strings.TrimSpace(q.Get("q"))
+	if s.query == "" {
+		s.query = strings.TrimSpace(q.Get("query"))
+	}
+	if s.query == "" && s.cursor == "" {
+		return s, badSearch(CodeMissingQuery, "Search query is required")
+	}
+	if !contains(searchableTypes, entityType) {
+		return s, badSearch(CodeUnknownEntityType, "Unknown entity type: "+entityType)
+	}
 
-	res, err := GetResultsOfType(r.Context(), entityType, query, 50)
+	var err error
+	if s.limit, err = queryInt(q, "limit"); err != nil {
+		return s, badSearch(CodeInvalidParameter, err.Error())
+	}
+	if s.offset, err = queryInt(q, "offset"); err != nil {
+		return s, badSearch(CodeInvalidParameter, err.Error())
+	}
+	hlOpts, highlight, err := highlightOptions(q)
 	if err != nil {
-		http.Error(w, "Error fetching search results", http.StatusInternalServerError)
-		return
+		return s, badSearch(CodeInvalidParameter, err.Error())
+	}
+	if highlight {
+		s.highlight = &hlOpts
+	}
+	if s.options, err = searchOptions(q, []string{entityType}); err != nil {
+		return s, badSearch(CodeInvalidParameter, err.Error())
 	}
+	s.autocorrect, _ = strconv.ParseBool(q.Get("autocorrect"))
+	return s, nil
+}
 
-	payload, err := json.Marshal(res)
+// runTypeSearch executes s; start is when the request arrived.
+func runTypeSearch(ctx context.Context, s typeSearch, start time.Time) (TypeSearchResponse, *searchError) {
+	page, err := SearchPageOfType(ctx, s.entityType, s.query, s.offset, s.limit, s.cursor, s.options)
+	if errors.Is(err, ErrInvalidQuery) {
+		return TypeSearchResponse{}, badSearch(CodeInvalidQuery, err.Error())
+	}
+	if errors.Is(err, ErrInvalidCursor) {
+		return TypeSearchResponse{}, badSearch(CodeInvalidCursor, err.Error())
+	}
 	if err != nil {
-		http.Error(w, "Error encoding JSON", http.StatusInternalServerError)
-		return
+		log.Printf("[runTypeSearch] SearchPageOfType error: %v", err)
+		return TypeSearchResponse{}, &searchError{status: http.StatusInternalServerError, code: CodeInternal, message: "Error fetching search results"}
+	}
+
+	// Nothing found: offer a spelling correction and, with autocorrect,
+	// answer with its results instead.
+	var suggestion, corrected string
+	if page.Total == 0 && s.cursor == "" {
+		suggestion, err = SuggestQuery(ctx, s.entityType, s.query)
+		if err != nil {
+			log.Printf("[runTypeSearch] SuggestQuery error: %v", err)
+		}
+		if s.autocorrect && suggestion != "" {
+			correctedPage, err := SearchPageOfType(ctx, s.entityType, suggestion, s.offset, s.limit, "", s.options)
+			if err != nil {
+				log.Printf("[runTypeSearch] corrected SearchPageOfType error: %v", err)
+				return TypeSearchResponse{}, &searchError{status: http.StatusInternalServerError, code: CodeInternal, message: "Error fetching search results"}
+			}
+			page, corrected, suggestion = correctedPage, suggestion, ""
+		}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	_, _ = w.Write(payload)
+	query := s.query
+	if query == "" {
+		query = page.Query
+	}
+	var hl *highlighter
+	if s.highlight != nil {
+		if hl, err = newHighlighter(ctx, s.entityType, page.Query, *s.highlight); err != nil {
+			log.Printf("[runTypeSearch] newHighlighter error: %v", err)
+			hl = nil
+		}
+	}
+
+	meta := newResponseMeta(query, queryTokens(s.entityType, page.Query), page.Total, start)
+	meta.Suggestion, meta.CorrectedQuery = suggestion, corrected
+	if s.cursor == "" {
+		s.options.describe(meta.Filters)
+	}
+	return TypeSearchResponse{
+		ResponseMeta: meta,
+		EntityType:   s.entityType,
+		Hits:         highlightHits(hl, page.Results),
+		Offset:       page.Offset,
+		Limit:        page.Limit,
+		NextCursor:   page.NextCursor,
+		Facets:       page.Facets,
+	}, nil
+}
+
+// queryInt reads an optional non-negative integer query parameter; a missing
+// one is 0.
+func queryInt(q url.Values, name string) (int, error) {
+	v := q.Get(name)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, errors.New(name + " must be a non-negative integer")
+	}
+	return n, nil
 }
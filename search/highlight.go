@@ -0,0 +1,242 @@
+package search
+
+import (
+	"context"
+	"errors"
+	"html"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// -------------------------
+// Hit highlighting
+// -------------------------
+
+const (
+	defaultSnippetSize = 160
+	minSnippetSize     = 40
+	maxSnippetSize     = 500
+	maxMarkerLen       = 32
+	snippetEllipsis    = "…"
+)
+
+// Hit is a search result with its highlighted fragments. Snippet is the
+// part of the description around the best-matching region, or its start
+// when nothing there matched. Highlights holds the other fields that
+// matched, keyed by field name. Fragment text is HTML-escaped so the
+// default markers can be rendered as markup.
+type Hit struct {
+	Entity
+	Snippet    string            `json:"snippet,omitempty"`
+	Highlights map[string]string `json:"highlights,omitempty"`
+}
+
+// HighlightOptions sets the markers wrapped around matched words and the
+// fragment length in characters.
+type HighlightOptions struct {
+	Pre         string
+	Post        string
+	SnippetSize int
+}
+
+func DefaultHighlightOptions() HighlightOptions {
+	return HighlightOptions{Pre: "<em>", Post: "</em>", SnippetSize: defaultSnippetSize}
+}
+
+// highlightOptions reads highlight_pre, highlight_post and snippet_size. It
+// reports false when the request disables highlighting with highlight=false.
+func highlightOptions(q url.Values) (HighlightOptions, bool, error) {
+	opts := DefaultHighlightOptions()
+	if v := q.Get("highlight"); v != "" {
+		on, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, false, errors.New("highlight must be true or false")
+		}
+		if !on {
+			return opts, false, nil
+		}
+	}
+	if q.Has("highlight_pre") || q.Has("highlight_post") {
+		opts.Pre, opts.Post = q.Get("highlight_pre"), q.Get("highlight_post")
+		if len(opts.Pre) > maxMarkerLen || len(opts.Post) > maxMarkerLen {
+			return opts, false, errors.New("highlight markers are limited to 32 bytes")
+		}
+	}
+	if v := q.Get("snippet_size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < minSnippetSize || n > maxSnippetSize {
+			return opts, false, errors.New("snippet_size must be between 40 and 500")
+		}
+		opts.SnippetSize = n
+	}
+	return opts, true, nil
+}
+
+// highlighter marks the words of hits that match a query. Words are
+// analysed one at a time with the entity's analyzer, so a word is marked
+// when any of its index-time terms (surface form or stem) is a query term
+// or one of its synonym or fuzzy expansions.
+type highlighter struct {
+	terms map[string]bool
+	opts  HighlightOptions
+}
+
+func newHighlighter(ctx context.Context, entityType, query string, opts HighlightOptions) (*highlighter, error) {
+	h := &highlighter{terms: map[string]bool{}, opts: opts}
+	a := searchAnalyzerFor(entityType)
+	node, err := ParseQueryWith(query, a)
+	if err != nil || node == nil {
+		return h, err
+	}
+	node, _, err = expandQuery(ctx, entityType, a, node)
+	if err != nil {
+		return h, err
+	}
+	for _, t := range positiveTerms(node, map[string]bool{}, nil) {
+		h.terms[t] = true
+	}
+	return h, nil
+}
+
+// hit returns e with its snippet and highlighted fields.
+func (h *highlighter) hit(e Entity) Hit {
+	hit := Hit{Entity: e}
+	a := analyzerFor(e.EntityType, e.Language)
+	for field, text := range entityFieldText(e) {
+		rs := []rune(text)
+		spans := h.matches(a, rs)
+		if field == FieldDescription {
+			hit.Snippet = h.fragment(rs, spans)
+			continue
+		}
+		if len(spans) > 0 {
+			if hit.Highlights == nil {
+				hit.Highlights = map[string]string{}
+			}
+			hit.Highlights[field] = h.fragment(rs, spans)
+		}
+	}
+	return hit
+}
+
+// wordSpan is a matched word, as rune offsets into the field text, and the
+// query term it matched.
+type wordSpan struct {
+	start, end int
+	term       string
+}
+
+// matches returns the words of rs that match a query term, in order. Words
+// are split the way unicodeTokens splits them; a run of CJK characters is
+// marked whole when any of its bigrams matches.
+func (h *highlighter) matches(a *Analyzer, rs []rune) []wordSpan {
+	if len(h.terms) == 0 {
+		return nil
+	}
+	var spans []wordSpan
+	for i := 0; i < len(rs); {
+		j := i
+		if rs[i] == '#' && i+1 < len(rs) && isWordRune(rs[i+1]) {
+			j++
+		} else if !isWordRune(rs[i]) || unicode.IsMark(rs[i]) {
+			i++
+			continue
+		}
+		for j < len(rs) && isWordRune(rs[j]) {
+			j++
+		}
+		for _, t := range a.Analyze(string(rs[i:j])) {
+			if h.terms[t.Term] {
+				spans = append(spans, wordSpan{start: i, end: j, term: t.Term})
+				break
+			}
+		}
+		i = j
+	}
+	return spans
+}
+
+// fragment cuts rs to the snippet size around the window with the most
+// distinct matched terms, then the most matches, and wraps matched words in
+// the markers. Without matches it is the start of rs.
+func (h *highlighter) fragment(rs []rune, spans []wordSpan) string {
+	size := h.opts.SnippetSize
+	if len(rs) <= size {
+		return h.mark(rs, spans, 0, len(rs))
+	}
+
+	winStart, winEnd := 0, 0
+	bestDistinct, bestCount := 0, 0
+	for i := range spans {
+		distinct := map[string]bool{}
+		count := 0
+		end := spans[i].end
+		for j := i; j < len(spans) && spans[j].end-spans[i].start <= size; j++ {
+			distinct[spans[j].term] = true
+			count++
+			end = spans[j].end
+		}
+		if len(distinct) > bestDistinct || (len(distinct) == bestDistinct && count > bestCount) {
+			bestDistinct, bestCount = len(distinct), count
+			winStart, winEnd = spans[i].start, end
+		}
+	}
+
+	// Centre the window in the fragment, then keep whole words at both ends.
+	start := max(0, winStart-(size-(winEnd-winStart))/2)
+	end := min(len(rs), start+size)
+	start = max(0, min(start, end-size))
+	for start > 0 && start < winStart && isWordRune(rs[start-1]) && isWordRune(rs[start]) {
+		start++
+	}
+	for end < len(rs) && end > winEnd && isWordRune(rs[end-1]) && isWordRune(rs[end]) {
+		end--
+	}
+	for start < winStart && unicode.IsSpace(rs[start]) {
+		start++
+	}
+	for end > winEnd && unicode.IsSpace(rs[end-1]) {
+		end--
+	}
+	return h.mark(rs, spans, start, end)
+}
+
+// mark escapes rs[start:end], wraps the spans inside it in the markers and
+// adds ellipses where text was cut.
+func (h *highlighter) mark(rs []rune, spans []wordSpan, start, end int) string {
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString(snippetEllipsis)
+	}
+	pos := start
+	for _, s := range spans {
+		if s.start < start || s.end > end {
+			continue
+		}
+		b.WriteString(html.EscapeString(string(rs[pos:s.start])))
+		b.WriteString(h.opts.Pre)
+		b.WriteString(html.EscapeString(string(rs[s.start:s.end])))
+		b.WriteString(h.opts.Post)
+		pos = s.end
+	}
+	b.WriteString(html.EscapeString(string(rs[pos:end])))
+	if end < len(rs) {
+		b.WriteString(snippetEllipsis)
+	}
+	return b.String()
+}
+
+// highlightHits wraps results as hits, highlighted when h is not nil.
+func highlightHits(h *highlighter, results []Entity) []Hit {
+	hits := make([]Hit, len(results))
+	for i, e := range results {
+		if h == nil {
+			hits[i] = Hit{Entity: e}
+		} else {
+			hits[i] = h.hit(e)
+		}
+	}
+	return hits
+}
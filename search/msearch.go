@@ -0,0 +1,213 @@
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// -------------------------
+// Multi-search
+// -------------------------
+
+const (
+	maxMultiSearchItems   = 20
+	multiSearchWorkers    = 4
+	maxMultiSearchBodyLen = 1 << 20
+)
+
+// MultiSearchRequest is one search of a POST /api/v1/msearch batch. Filters
+// takes the attribute filters and drill-down selections under the names
+// the type search endpoint uses for them (category, price_min,
+// facet.city, ...).
+type MultiSearchRequest struct {
+	Type        string            `json:"type"`
+	Query       string            `json:"q"`
+	Limit       int               `json:"limit,omitempty"`
+	Offset      int               `json:"offset,omitempty"`
+	Cursor      string            `json:"cursor,omitempty"`
+	Sort        string            `json:"sort,omitempty"`
+	Filters     map[string]string `json:"filters,omitempty"`
+	Facets      []string          `json:"facets,omitempty"`
+	Highlight   *bool             `json:"highlight,omitempty"`
+	Autocorrect bool              `json:"autocorrect,omitempty"`
+}
+
+var multiSearchFilters = []string{"category", "status", "price_min", "price_max", "created_after", "created_before"}
+
+// values turns the request into type search parameters.
+func (m MultiSearchRequest) values() (url.Values, error) {
+	q := url.Values{}
+	set := func(k, v string) {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	set("q", m.Query)
+	set("cursor", m.Cursor)
+	set("sort", m.Sort)
+	set("facets", strings.Join(m.Facets, ","))
+	if m.Limit != 0 {
+		q.Set("limit", strconv.Itoa(m.Limit))
+	}
+	if m.Offset != 0 {
+		q.Set("offset", strconv.Itoa(m.Offset))
+	}
+	if m.Highlight != nil {
+		q.Set("highlight", strconv.FormatBool(*m.Highlight))
+	}
+	if m.Autocorrect {
+		q.Set("autocorrect", "true")
+	}
+	for k, v := range m.Filters {
+		if !contains(multiSearchFilters, k) && !strings.HasPrefix(k, "facet.") {
+			return nil, errors.New("unknown filter " + strconv.Quote(k))
+		}
+		set(k, v)
+	}
+	return q, nil
+}
+
+// MultiSearchResult is the outcome of one search of a batch: a type search
+// response or an error, with the HTTP status it would have had alone.
+type MultiSearchResult struct {
+	Status int `json:"status"`
+	*TypeSearchResponse
+	Error *ErrorBody `json:"error,omitempty"`
+}
+
+// MultiSearchResponse is the body of POST /api/v1/msearch. Responses are in
+// request order.
+type MultiSearchResponse struct {
+	Version   string              `json:"version"`
+	TookMs    int64               `json:"took_ms"`
+	Responses []MultiSearchResult `json:"responses"`
+}
+
+// MultiSearch runs independent type searches concurrently. Searches of the
+// same type and query share one ranking pass. A failing search is reported
+// in its own result without affecting the others.
+func MultiSearch(ctx context.Context, reqs []MultiSearchRequest) []MultiSearchResult {
+	log.Printf("[MultiSearch] START searches=%d", len(reqs))
+	ctx = withRankCache(ctx)
+	out := make([]MultiSearchResult, len(reqs))
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(multiSearchWorkers, len(reqs)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				out[i] = runMultiSearchItem(ctx, reqs[i])
+			}
+		}()
+	}
+	for i := range reqs {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	log.Printf("[MultiSearch] END searches=%d", len(reqs))
+	return out
+}
+
+func runMultiSearchItem(ctx context.Context, req MultiSearchRequest) MultiSearchResult {
+	start := time.Now()
+	q, err := req.values()
+	if err != nil {
+		return multiSearchError(badSearch(CodeInvalidParameter, err.Error()))
+	}
+	s, serr := parseTypeSearch(strings.ToLower(strings.TrimSpace(req.Type)), q)
+	if serr != nil {
+		return multiSearchError(serr)
+	}
+	res, serr := runTypeSearch(ctx, s, start)
+	if serr != nil {
+		return multiSearchError(serr)
+	}
+	return MultiSearchResult{Status: http.StatusOK, TypeSearchResponse: &res}
+}
+
+func multiSearchError(e *searchError) MultiSearchResult {
+	return MultiSearchResult{Status: e.status, Error: &ErrorBody{Code: e.code, Message: e.message}}
+}
+
+// MultiSearchHandler serves POST /api/v1/msearch with a JSON array of
+// MultiSearchRequest.
+func MultiSearchHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	start := time.Now()
+	var reqs []MultiSearchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMultiSearchBodyLen)).Decode(&reqs); err != nil {
+		writeSearchError(w, http.StatusBadRequest, CodeInvalidParameter, "body must be a JSON array of searches")
+		return
+	}
+	if len(reqs) == 0 {
+		writeSearchError(w, http.StatusBadRequest, CodeInvalidParameter, "at least one search is required")
+		return
+	}
+	if len(reqs) > maxMultiSearchItems {
+		writeSearchError(w, http.StatusBadRequest, CodeInvalidParameter, "at most 20 searches per request")
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, MultiSearchResponse{
+		Version:   ResponseVersion,
+		Responses: MultiSearch(r.Context(), reqs),
+		TookMs:    time.Since(start).Milliseconds(),
+	})
+}
+
+// -------------------------
+// Request-scoped ranking cache
+// -------------------------
+
+// rankCache shares ranked ids between searches of one request.
+type rankCache struct {
+	mu      sync.Mutex
+	entries map[string]*rankEntry
+}
+
+type rankEntry struct {
+	once sync.Once
+	ids  []string
+	err  error
+}
+
+type rankCacheKey struct{}
+
+func withRankCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, rankCacheKey{}, &rankCache{entries: map[string]*rankEntry{}})
+}
+
+// rankedIDs returns every match of query in the entityType index, ranked,
+// from the request's rank cache when it has one. The slice must not be
+// modified.
+func rankedIDs(ctx context.Context, entityType, query string) ([]string, error) {
+	c, ok := ctx.Value(rankCacheKey{}).(*rankCache)
+	if !ok {
+		return GetIndexResultsForType(ctx, entityType, query, 0)
+	}
+	key := entityType + "\x00" + query
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if !ok {
+		e = &rankEntry{}
+		c.entries[key] = e
+	}
+	c.mu.Unlock()
+	e.once.Do(func() {
+		e.ids, e.err = GetIndexResultsForType(ctx, entityType, query, 0)
+	})
+	return e.ids, e.err
+}
@@ -0,0 +1,211 @@
+package search
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// -------------------------
+// Search options
+// -------------------------
+
+// SearchOptions narrows, orders and annotates a search. Filters restricts
+// matches by their attributes. Facets names the facets to count;
+// FacetFilters drills down to matches having, for every named facet, one of
+// the listed values (compared case-insensitively). Sort names a sortOrders
+// entry; empty means relevance.
+type SearchOptions struct {
+	Filters      AttributeFilters
+	Facets       []string
+	FacetFilters map[string][]string
+	Sort         string
+}
+
+// needsMeta reports whether applying o reads the docmeta of the matches.
+func (o SearchOptions) needsMeta() bool {
+	return !o.Filters.empty() || len(o.Facets) > 0 || len(o.FacetFilters) > 0 ||
+		(o.Sort != "" && o.Sort != SortRelevance)
+}
+
+// applyOptions keeps the ids passing opts.Filters and opts.FacetFilters,
+// orders them by opts.Sort and counts the requested facets, reading every
+// docmeta once. Each facet is counted over the matches passing the
+// attribute filters and the other facets' filters, so choosing a value does
+// not hide its alternatives.
+func applyOptions(ctx context.Context, ids []string, opts SearchOptions) ([]string, []Facet, error) {
+	metas, err := fetchDocMetas(ctx, ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	kept := ids[:0:0]
+	keptMetas := make([]map[string]string, 0, len(ids))
+	for i, id := range ids {
+		if !opts.Filters.matches(metas[i]) {
+			metas[i] = nil
+			continue
+		}
+		if matchesFacets(metas[i], opts.FacetFilters, "") {
+			kept = append(kept, id)
+			keptMetas = append(keptMetas, metas[i])
+		}
+	}
+	if order, ok := sortOrders[opts.Sort]; ok && order.field != "" {
+		kept = order.apply(kept, keptMetas)
+	}
+
+	facets := make([]Facet, 0, len(opts.Facets))
+	for _, name := range opts.Facets {
+		facets = append(facets, countFacet(name, metas, opts.FacetFilters))
+	}
+	return kept, facets, nil
+}
+
+// searchOptions reads the attribute filters (see attributeFilters),
+// ?facets=category,tags, drill-down selections given as facet.<name>=value
+// (repeatable or comma-separated) and ?sort=, which must be valid for every
+// type in types.
+func searchOptions(q url.Values, types []string) (SearchOptions, error) {
+	var opts SearchOptions
+	var err error
+	if opts.Filters, err = attributeFilters(q); err != nil {
+		return opts, err
+	}
+	for _, name := range strings.Split(q.Get("facets"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || contains(opts.Facets, name) {
+			continue
+		}
+		if !contains(facetNames, name) {
+			return opts, fmt.Errorf("unknown facet %q", name)
+		}
+		opts.Facets = append(opts.Facets, name)
+	}
+	for key, values := range q {
+		name, ok := strings.CutPrefix(key, "facet.")
+		if !ok {
+			continue
+		}
+		name = strings.ToLower(name)
+		if !contains(facetNames, name) {
+			return opts, fmt.Errorf("unknown facet %q", name)
+		}
+		for _, v := range values {
+			for _, part := range strings.Split(v, ",") {
+				if part = strings.TrimSpace(part); part != "" {
+					if opts.FacetFilters == nil {
+						opts.FacetFilters = map[string][]string{}
+					}
+					opts.FacetFilters[name] = append(opts.FacetFilters[name], part)
+				}
+			}
+		}
+	}
+	if opts.Sort, err = sortFor(strings.ToLower(strings.TrimSpace(q.Get("sort"))), types); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+// describe records the filters, drill-down selections and sort order of o
+// in the response envelope's filters.
+func (o SearchOptions) describe(filters map[string]string) {
+	o.Filters.describe(filters)
+	for name, values := range o.FacetFilters {
+		filters["facet."+name] = strings.Join(values, ",")
+	}
+	if o.Sort != "" {
+		filters["sort"] = o.Sort
+	}
+}
+
+// -------------------------
+// Sort orders
+// -------------------------
+
+const (
+	SortRelevance  = "relevance"
+	SortNewest     = "newest"
+	SortOldest     = "oldest"
+	SortPopularity = "popularity"
+	SortPriceAsc   = "price_asc"
+	SortPriceDesc  = "price_desc"
+	SortDate       = "date"
+	SortWage       = "wage"
+	SortRating     = "rating"
+)
+
+// sortOrder orders matches by a numeric docmeta field. Matches without the
+// field come last and ties keep their relevance order. types limits the
+// order to those entity types; nil allows it everywhere.
+type sortOrder struct {
+	field string
+	desc  bool
+	types []string
+}
+
+var sortOrders = map[string]sortOrder{
+	SortRelevance:  {},
+	SortNewest:     {field: "created", desc: true},
+	SortOldest:     {field: "created"},
+	SortPopularity: {field: "popularity", desc: true},
+	SortPriceAsc:   {field: "price", types: []string{"products", "crops", "merch", "menu"}},
+	SortPriceDesc:  {field: "price", desc: true, types: []string{"products", "crops", "merch", "menu"}},
+	SortDate:       {field: "date", types: []string{"events"}},
+	SortWage:       {field: "wage", desc: true, types: []string{"baitos"}},
+	SortRating:     {field: "rating", desc: true, types: []string{"farms", "merch"}},
+}
+
+// sortFor validates a requested sort order against the searched types.
+func sortFor(name string, types []string) (string, error) {
+	if name == "" {
+		return "", nil
+	}
+	order, ok := sortOrders[name]
+	if !ok {
+		return "", fmt.Errorf("unknown sort %q", name)
+	}
+	if order.types == nil {
+		return name, nil
+	}
+	if len(types) == 0 {
+		return "", fmt.Errorf("sort %q needs one of the types %s", name, strings.Join(order.types, ", "))
+	}
+	for _, t := range types {
+		if !contains(order.types, t) {
+			return "", fmt.Errorf("sort %q is not available for %s", name, t)
+		}
+	}
+	return name, nil
+}
+
+func (o sortOrder) apply(ids []string, metas []map[string]string) []string {
+	type keyed struct {
+		id    string
+		value float64
+		ok    bool
+	}
+	rows := make([]keyed, len(ids))
+	for i, id := range ids {
+		v, err := strconv.ParseFloat(metas[i][o.field], 64)
+		rows[i] = keyed{id: id, value: v, ok: err == nil}
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if a.ok != b.ok {
+			return a.ok
+		}
+		if o.desc {
+			return a.value > b.value
+		}
+		return a.value < b.value
+	})
+	out := make([]string, len(rows))
+	for i, r := range rows {
+		out[i] = r.id
+	}
+	return out
+}
@@ -0,0 +1,208 @@
+package search
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"naevis/db"
+	"naevis/globals"
+	"naevis/utils"
+)
+
+// -------------------------
+// Pagination
+// -------------------------
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 100
+	// A snapshot of the ranked ids backs the cursors of one search for this
+	// long after its last page was read.
+	snapshotTTL = 15 * time.Minute
+	// At most this many ranked ids are kept in a snapshot, and counted in
+	// Total.
+	maxSnapshotHits = 10000
+)
+
+// ErrInvalidCursor is returned (wrapped) for malformed, foreign or expired
+// cursors.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// SearchPage is one page of a type search. NextCursor is empty on the last
+// page.
+type SearchPage struct {
+	// Query is the query the page answers; on cursor pages it is the one the
+	// cursor was issued for.
+	Query   string   `json:"query"`
+	Results []Entity `json:"results"`
+	// Total counts the matches, at most maxSnapshotHits.
+	Total      int    `json:"total"`
+	Offset     int    `json:"offset"`
+	Limit      int    `json:"limit"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	// Facets holds the counts requested in SearchOptions.Facets; cursor pages
+	// leave it empty.
+	Facets []Facet `json:"facets,omitempty"`
+}
+
+// pageCursor is the decoded form of an opaque cursor: the snapshot of the
+// search it continues and where the next page starts.
+type pageCursor struct {
+	Type     string `json:"t"`
+	Query    string `json:"q"`
+	Snapshot string `json:"s"`
+	Offset   int    `json:"o"`
+	Limit    int    `json:"l"`
+}
+
+// snapshotKey holds the ranked ids of one search, taken when its first
+// page was served. Every search gets its own, named by a random id.
+func snapshotKey(id string) string { return "searchsnap:" + id }
+
+func encodeCursor(c pageCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (pageCursor, error) {
+	var c pageCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || json.Unmarshal(data, &c) != nil || c.Type == "" || c.Snapshot == "" || c.Offset < 0 {
+		return c, fmt.Errorf("%w: malformed", ErrInvalidCursor)
+	}
+	return c, nil
+}
+
+// clampPageSize applies the default and the maximum to a requested limit.
+func clampPageSize(limit int) int {
+	if limit <= 0 {
+		return defaultPageSize
+	}
+	return min(limit, maxPageSize)
+}
+
+// SearchPageOfType returns the page of entityType results for query that
+// starts at offset, narrowed and counted as opts asks. With a cursor from a
+// previous page, query, offset and opts are ignored and the page continues
+// that search. When a search has more than one page, its ranked ids are
+// stored in a snapshot as the first page is served and every cursor reads
+// from it, so entities indexed or re-ranked meanwhile neither shift nor
+// repeat results across pages.
+func SearchPageOfType(ctx context.Context, entityType, query string, offset, limit int, cursor string, opts SearchOptions) (SearchPage, error) {
+	log.Printf("[SearchPageOfType] START entityType=%q query=%q offset=%d limit=%d cursor=%q", entityType, query, offset, limit, cursor)
+	if cursor != "" {
+		return continuePage(ctx, entityType, cursor, limit)
+	}
+	limit = clampPageSize(limit)
+	if offset < 0 {
+		offset = 0
+	}
+	page := SearchPage{Query: query, Results: []Entity{}, Offset: offset, Limit: limit}
+
+	ids, facets, err := matchingIDs(ctx, entityType, query, opts)
+	if err != nil {
+		return page, err
+	}
+	ids = ids[:min(len(ids), maxSnapshotHits)]
+	page.Total, page.Facets = len(ids), facets
+
+	end := min(offset+limit, len(ids))
+	if end < len(ids) {
+		snap, err := takeSnapshot(ctx, ids)
+		if err != nil {
+			return page, err
+		}
+		page.NextCursor = encodeCursor(pageCursor{Type: entityType, Query: query, Snapshot: snap, Offset: end, Limit: limit})
+	}
+	if offset < end {
+		if page.Results, err = fetchPage(ctx, ids[offset:end], entityType); err != nil {
+			return page, err
+		}
+	}
+	log.Printf("[SearchPageOfType] END total=%d results=%d next=%v", page.Total, len(page.Results), page.NextCursor != "")
+	return page, nil
+}
+
+// matchingIDs returns the ranked ids of entityType matching query that pass
+// opts, and the facet counts opts asks for.
+func matchingIDs(ctx context.Context, entityType, query string, opts SearchOptions) ([]string, []Facet, error) {
+	ids, err := rankedIDs(ctx, entityType, query)
+	if err != nil || !opts.needsMeta() {
+		return ids, nil, err
+	}
+	return applyOptions(ctx, ids, opts)
+}
+
+func continuePage(ctx context.Context, entityType, cursor string, limit int) (SearchPage, error) {
+	c, err := decodeCursor(cursor)
+	if err != nil {
+		return SearchPage{}, err
+	}
+	if c.Type != entityType {
+		return SearchPage{}, fmt.Errorf("%w: issued for %q", ErrInvalidCursor, c.Type)
+	}
+	if limit <= 0 {
+		limit = c.Limit
+	}
+	limit = clampPageSize(limit)
+	page := SearchPage{Query: c.Query, Results: []Entity{}, Offset: c.Offset, Limit: limit}
+
+	ids, n, err := readSnapshot(ctx, snapshotKey(c.Snapshot), c.Offset, limit)
+	if err != nil {
+		return page, err
+	}
+	if n == 0 {
+		return page, fmt.Errorf("%w: expired", ErrInvalidCursor)
+	}
+	page.Total = int(n)
+
+	if page.Results, err = fetchPage(ctx, ids, entityType); err != nil {
+		return page, err
+	}
+	if end := c.Offset + len(ids); int64(end) < n {
+		c.Offset, c.Limit = end, limit
+		page.NextCursor = encodeCursor(c)
+	}
+	return page, nil
+}
+
+// takeSnapshot stores ids under a new snapshot and returns its id.
+func takeSnapshot(ctx context.Context, ids []string) (string, error) {
+	members := make([]interface{}, len(ids))
+	for i, id := range ids {
+		members[i] = id
+	}
+	snap := utils.GenerateRandomString(16)
+	pipe := globals.RedisClient.TxPipeline()
+	pipe.RPush(ctx, snapshotKey(snap), members...)
+	pipe.Expire(ctx, snapshotKey(snap), snapshotTTL)
+	_, err := pipe.Exec(ctx)
+	return snap, err
+}
+
+// readSnapshot returns limit ids of the snapshot at key from offset and the
+// snapshot's length, 0 when it has expired. Reading a snapshot keeps it for
+// another snapshotTTL.
+func readSnapshot(ctx context.Context, key string, offset, limit int) ([]string, int64, error) {
+	pipe := globals.RedisClient.Pipeline()
+	idsCmd := pipe.LRange(ctx, key, int64(offset), int64(offset+limit-1))
+	lenCmd := pipe.LLen(ctx, key)
+	pipe.Expire(ctx, key, snapshotTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, 0, err
+	}
+	return idsCmd.Val(), lenCmd.Val(), nil
+}
+
+func fetchPage(ctx context.Context, ids []string, entityType string) ([]Entity, error) {
+	res, err := fetchByIDs[Entity](ctx, ids, db.Client.Database("naevis").Collection("search"), entityType)
+	if res == nil {
+		res = []Entity{}
+	}
+	return res, err
+}
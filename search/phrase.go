@@ -0,0 +1,146 @@
+package search
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+
+	"naevis/globals"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// -------------------------
+// Phrase and proximity queries
+// -------------------------
+
+// phraseQuery is a run of terms that must occur together in one field.
+// offsets are the terms' positions relative to the first, so a stopword
+// removed from the middle of the phrase still has to fill its slot. With
+// slop 0 the terms must appear at exactly those offsets; with slop N they may
+// appear in any order as long as they all fit in a window N positions wider
+// than the phrase itself. Terms marked in stops are stop words kept in the
+// phrase: they have no postings and only take part in the position check.
+type phraseQuery struct {
+	terms   []string
+	offsets []int
+	stops   []bool
+	slop    int
+}
+
+// isStop reports whether term i is a kept stop word.
+func (q phraseQuery) isStop(i int) bool {
+	return i < len(q.stops) && q.stops[i]
+}
+
+// offset returns the relative position of term i, defaulting to i.
+func (q phraseQuery) offset(i int) int {
+	if i < len(q.offsets) {
+		return q.offsets[i]
+	}
+	return i
+}
+
+// filterPhraseMatches keeps the ids that satisfy phrase in at least one of
+// fields, preserving their order. Documents indexed without positions never
+// match.
+func filterPhraseMatches(ctx context.Context, phrase phraseQuery, fields []string, ids []string) ([]string, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	pipe := globals.RedisClient.Pipeline()
+	cmds := make(map[string][]*redis.SliceCmd, len(fields))
+	for _, f := range fields {
+		cmds[f] = make([]*redis.SliceCmd, len(phrase.terms))
+		for i, t := range phrase.terms {
+			cmds[f][i] = pipe.HMGet(ctx, positionsKey(f, t), ids...)
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+
+	out := make([]string, 0, len(ids))
+	for j, id := range ids {
+		for _, f := range fields {
+			lists := make([][]int, len(phrase.terms))
+			complete := true
+			for i := range phrase.terms {
+				s, _ := cmds[f][i].Val()[j].(string)
+				lists[i] = decodePositions(s)
+				if len(lists[i]) == 0 {
+					complete = false
+					break
+				}
+			}
+			if complete && positionsMatch(lists, phrase) {
+				out = append(out, id)
+				break
+			}
+		}
+	}
+	log.Printf("[filterPhraseMatches] terms=%v slop=%d kept=%d/%d", phrase.terms, phrase.slop, len(out), len(ids))
+	return out, nil
+}
+
+// positionsMatch reports whether one position can be picked from each list
+// so that the picks form the phrase: at the phrase's offsets when slop is 0,
+// otherwise within a window of the phrase's span plus slop positions.
+func positionsMatch(lists [][]int, phrase phraseQuery) bool {
+	if phrase.slop == 0 {
+		sets := make([]map[int]struct{}, len(lists))
+		for i, l := range lists {
+			sets[i] = make(map[int]struct{}, len(l))
+			for _, p := range l {
+				sets[i][p] = struct{}{}
+			}
+		}
+		for _, start := range lists[0] {
+			ok := true
+			for i := 1; i < len(sets); i++ {
+				if _, found := sets[i][start+phrase.offset(i)-phrase.offset(0)]; !found {
+					ok = false
+					break
+				}
+			}
+			if ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Smallest window covering every list: slide over all positions in order.
+	type hit struct{ pos, list int }
+	var hits []hit
+	for i, l := range lists {
+		for _, p := range l {
+			hits = append(hits, hit{pos: p, list: i})
+		}
+	}
+	sort.Slice(hits, func(a, b int) bool { return hits[a].pos < hits[b].pos })
+
+	maxSpan := phrase.offset(len(lists)-1) - phrase.offset(0) + phrase.slop
+	counts := make([]int, len(lists))
+	covered := 0
+	left := 0
+	for _, h := range hits {
+		if counts[h.list] == 0 {
+			covered++
+		}
+		counts[h.list]++
+		for covered == len(lists) {
+			if h.pos-hits[left].pos <= maxSpan {
+				return true
+			}
+			counts[hits[left].list]--
+			if counts[hits[left].list] == 0 {
+				covered--
+			}
+			left++
+		}
+	}
+	return false
+}
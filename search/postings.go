@@ -0,0 +1,218 @@
+package search
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+
+	"naevis/globals"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// -------------------------
+// Redis keys for per-field postings and corpus statistics
+// -------------------------
+
+// termFreqKey holds, per field and token, a hash of entityID -> term
+// frequency within that field.
+func termFreqKey(field, token string) string { return "tf:" + field + ":" + token }
+
+// positionsKey holds, per field and token, a hash of entityID -> the
+// comma-separated token positions within that field.
+func positionsKey(field, token string) string { return "pos:" + field + ":" + token }
+
+// docLenKey holds a hash of entityID -> document length in tokens. Its
+// HLEN is the number of indexed documents.
+func docLenKey() string { return "doclen" }
+
+// docMetaKey holds a hash describing one indexed document: its entity type
+// ("type"), creation time in unix nanoseconds ("created"), its length per
+// field ("len:<field>"), its facet values ("facet:<name>"), its filter
+// attributes ("price", "status") and sort keys ("popularity", "rating",
+// "wage", "date").
+func docMetaKey(id string) string { return "docmeta:" + id }
+
+// typeSetKey holds the set of indexed entityIDs of one entity type.
+func typeSetKey(entityType string) string { return "typeset:" + entityType }
+
+// docTermsKey holds the set of postings a document is indexed under, as
+// "t:<field>:<token>" for terms and "s:<field>:<word>" for stop word
+// positions, so the document can be unindexed once its source is gone.
+func docTermsKey(id string) string { return "docterms:" + id }
+
+// corpusStatsKey holds running corpus totals: "totallen" and
+// "totallen:<field>".
+func corpusStatsKey() string { return "corpus:stats" }
+
+// docMeta is what the index remembers about a document, used to undo its
+// contribution to the corpus statistics.
+type docMeta struct {
+	indexed    bool
+	entityType string
+	length     int
+	fieldLen   map[string]int
+}
+
+func getDocMeta(ctx context.Context, id string) (docMeta, error) {
+	metas, err := getDocMetas(ctx, []string{id})
+	if err != nil {
+		return docMeta{}, err
+	}
+	return metas[0], nil
+}
+
+// getDocMetas reads the docMeta of every id, in order, in one pipeline.
+func getDocMetas(ctx context.Context, ids []string) ([]docMeta, error) {
+	pipe := globals.RedisClient.Pipeline()
+	lenCmds := make([]*redis.StringCmd, len(ids))
+	metaCmds := make([]*redis.MapStringStringCmd, len(ids))
+	for i, id := range ids {
+		lenCmds[i] = pipe.HGet(ctx, docLenKey(), id)
+		metaCmds[i] = pipe.HGetAll(ctx, docMetaKey(id))
+	}
+	if len(ids) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+			return nil, err
+		}
+	}
+
+	out := make([]docMeta, len(ids))
+	for i := range ids {
+		meta := docMeta{fieldLen: map[string]int{}}
+		if n, err := lenCmds[i].Int(); err == nil {
+			meta.indexed = true
+			meta.length = n
+		}
+		for k, v := range metaCmds[i].Val() {
+			switch {
+			case k == "type":
+				meta.entityType = v
+			case strings.HasPrefix(k, "len:"):
+				n, _ := strconv.Atoi(v)
+				meta.fieldLen[strings.TrimPrefix(k, "len:")] = n
+			}
+		}
+		out[i] = meta
+	}
+	return out, nil
+}
+
+// indexDocPipeline queues every posting and statistic for e.
+func indexDocPipeline(ctx context.Context, pipe redis.Pipeliner, e Entity, dt docTerms) {
+	log.Printf("[indexDocPipeline] id=%q tokens=%d length=%d", e.EntityID, len(dt.tokens), dt.length)
+	score := float64(e.CreatedAt.UnixNano())
+	for token := range dt.tokens {
+		addToIndexPipeline(ctx, pipe, invertedKey(token), e.EntityID, score)
+		if strings.HasPrefix(token, "#") {
+			addToIndexPipeline(ctx, pipe, hashtagKey(token), e.EntityID, score)
+		}
+	}
+	for word := range dt.words {
+		pipe.ZAdd(ctx, autocompleteZSet(), redis.Z{Score: 0, Member: word})
+	}
+	for field, tf := range dt.fieldTF {
+		for token, n := range tf {
+			pipe.HSet(ctx, termFreqKey(field, token), e.EntityID, n)
+			pipe.HSet(ctx, positionsKey(field, token), e.EntityID, encodePositions(dt.fieldPos[field][token]))
+		}
+	}
+	for field, stops := range dt.fieldStopPos {
+		for word, pos := range stops {
+			pipe.HSet(ctx, positionsKey(field, word), e.EntityID, encodePositions(pos))
+		}
+	}
+
+	meta := facetMeta(e)
+	for k, v := range attributeMeta(e) {
+		meta[k] = v
+	}
+	meta["type"], meta["created"] = e.EntityType, e.CreatedAt.UnixNano()
+	for field, n := range dt.fieldLen {
+		meta["len:"+field] = n
+		pipe.HIncrBy(ctx, corpusStatsKey(), "totallen:"+field, int64(n))
+	}
+	pipe.HSet(ctx, docMetaKey(e.EntityID), meta)
+	pipe.Del(ctx, docTermsKey(e.EntityID))
+	if members := dt.termMembers(); len(members) > 0 {
+		pipe.SAdd(ctx, docTermsKey(e.EntityID), members)
+	}
+	pipe.SAdd(ctx, typeSetKey(e.EntityType), e.EntityID)
+	pipe.HSet(ctx, docLenKey(), e.EntityID, dt.length)
+	pipe.HIncrBy(ctx, corpusStatsKey(), "totallen", int64(dt.length))
+}
+
+// unindexDocPipeline queues removal of the postings in dt and of the
+// statistics recorded in meta for the document id.
+func unindexDocPipeline(ctx context.Context, pipe redis.Pipeliner, id string, dt docTerms, meta docMeta) {
+	log.Printf("[unindexDocPipeline] id=%q tokens=%d", id, len(dt.tokens))
+	for token := range dt.tokens {
+		deleteFromIndexPipeline(ctx, pipe, invertedKey(token), id)
+		if strings.HasPrefix(token, "#") {
+			deleteFromIndexPipeline(ctx, pipe, hashtagKey(token), id)
+		}
+	}
+	for field, tf := range dt.fieldTF {
+		for token := range tf {
+			pipe.HDel(ctx, termFreqKey(field, token), id)
+			pipe.HDel(ctx, positionsKey(field, token), id)
+		}
+	}
+	for field, stops := range dt.fieldStopPos {
+		for word := range stops {
+			pipe.HDel(ctx, positionsKey(field, word), id)
+		}
+	}
+	pipe.Del(ctx, docTermsKey(id))
+	removeDocStatsPipeline(ctx, pipe, id, meta)
+}
+
+// storedDocTerms returns the postings recorded for id under docTermsKey.
+// Documents indexed before the key existed come back empty.
+func storedDocTerms(ctx context.Context, id string) (docTerms, error) {
+	members, err := globals.RedisClient.SMembers(ctx, docTermsKey(id)).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return docTerms{}, err
+	}
+	return parseDocTerms(members), nil
+}
+
+// removeDocStatsPipeline takes a document out of the corpus statistics.
+func removeDocStatsPipeline(ctx context.Context, pipe redis.Pipeliner, id string, meta docMeta) {
+	if !meta.indexed {
+		return
+	}
+	for field, n := range meta.fieldLen {
+		pipe.HIncrBy(ctx, corpusStatsKey(), "totallen:"+field, int64(-n))
+	}
+	pipe.HIncrBy(ctx, corpusStatsKey(), "totallen", int64(-meta.length))
+	pipe.HDel(ctx, docLenKey(), id)
+	pipe.Del(ctx, docMetaKey(id))
+	if meta.entityType != "" {
+		pipe.SRem(ctx, typeSetKey(meta.entityType), id)
+	}
+}
+
+func encodePositions(pos []int) string {
+	parts := make([]string, len(pos))
+	for i, p := range pos {
+		parts[i] = strconv.Itoa(p)
+	}
+	return strings.Join(parts, ",")
+}
+
+func decodePositions(s string) []int {
+	if s == "" {
+		return nil
+	}
+	parts := strings.Split(s, ",")
+	out := make([]int, 0, len(parts))
+	for _, p := range parts {
+		if n, err := strconv.Atoi(p); err == nil {
+			out = append(out, n)
+		}
+	}
+	return out
+}
@@ -4,6 +4,8 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 )
 
+// Projections whitelists the source fields of each collection that may be
+// returned to clients.
 var Projections = map[string]bson.M{
 	"artists": {
 		"artistid": 1, "category": 1, "name": 1, "country": 1,
@@ -77,3 +79,38 @@ var Projections = map[string]bson.M{
 		"createdAt": 1, "updatedAt": 1,
 	},
 }
+
+// EntityIDFields names the field holding the entity id in each collection.
+var EntityIDFields = map[string]string{
+	"artists":      "artistid",
+	"baitos":       "baitoid",
+	"baitoworkers": "baito_user_id",
+	"blogposts":    "postid",
+	"crops":        "cropid",
+	"events":       "eventid",
+	"media":        "mediaid",
+	"menu":         "menuid",
+	"merch":        "merchid",
+	"places":       "placeid",
+	"feedposts":    "postid",
+	"products":     "productid",
+	"recipes":      "recipeid",
+	"songs":        "songid",
+	"users":        "userid",
+	"farms":        "farmid",
+}
+
+// projectionFor returns the projection of a collection with _id left out,
+// or an empty projection for collections without a whitelist.
+func projectionFor(collectionName string) bson.M {
+	fields, ok := Projections[collectionName]
+	if !ok {
+		return bson.M{}
+	}
+	out := make(bson.M, len(fields)+1)
+	for k, v := range fields {
+		out[k] = v
+	}
+	out["_id"] = 0
+	return out
+}
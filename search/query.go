@@ -0,0 +1,850 @@
+package search
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"naevis/globals"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrInvalidQuery is returned (wrapped) when a query cannot be parsed.
+var ErrInvalidQuery = errors.New("invalid query")
+
+// -------------------------
+// Query AST
+// -------------------------
+
+// queryNode is a node of a parsed query. Evaluation turns every node into a
+// set of entity IDs.
+type queryNode interface{}
+
+// termNode matches documents containing term, in any field when field is
+// empty.
+type termNode struct {
+	field string
+	term  string
+}
+
+// phraseNode matches documents containing the phrase, in any field when
+// field is empty.
+type phraseNode struct {
+	field  string
+	phrase phraseQuery
+}
+
+// typeNode matches every indexed document of one entity type. ParseQuery
+// only accepts it as a filter beside a text term.
+type typeNode struct {
+	entityType string
+}
+
+type andNode struct{ children []queryNode }
+type orNode struct{ children []queryNode }
+type notNode struct{ child queryNode }
+
+// -------------------------
+// Lexer
+// -------------------------
+
+type lexKind int
+
+const (
+	lexWord lexKind = iota
+	lexPhrase
+	lexLParen
+	lexRParen
+	lexAnd
+	lexOr
+	lexNot
+	lexField
+)
+
+type lexToken struct {
+	kind lexKind
+	text string
+	slop int
+}
+
+// queryFields are the qualifiers recognised before a colon, e.g. title:tea.
+var queryFields = map[string]bool{
+	FieldTitle: true, FieldDescription: true, FieldTags: true, FieldCategory: true,
+	"type": true,
+}
+
+func lexQuery(q string) ([]lexToken, error) {
+	var out []lexToken
+	rs := []rune(q)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			out = append(out, lexToken{kind: lexLParen})
+			i++
+		case r == ')':
+			out = append(out, lexToken{kind: lexRParen})
+			i++
+		case r == '"':
+			end := i + 1
+			for end < len(rs) && rs[end] != '"' {
+				end++
+			}
+			if end >= len(rs) {
+				return nil, fmt.Errorf("%w: unterminated phrase", ErrInvalidQuery)
+			}
+			tok := lexToken{kind: lexPhrase, text: string(rs[i+1 : end])}
+			i = end + 1
+			if i < len(rs) && rs[i] == '~' {
+				j := i + 1
+				for j < len(rs) && unicode.IsDigit(rs[j]) {
+					j++
+				}
+				tok.slop, _ = strconv.Atoi(string(rs[i+1 : j]))
+				i = j
+			}
+			out = append(out, tok)
+		case r == '-' && i+1 < len(rs) && !unicode.IsSpace(rs[i+1]):
+			out = append(out, lexToken{kind: lexNot})
+			i++
+		default:
+			end := i
+			for end < len(rs) && !unicode.IsSpace(rs[end]) && rs[end] != '(' && rs[end] != ')' && rs[end] != '"' {
+				end++
+			}
+			word := string(rs[i:end])
+			i = end
+			switch word {
+			case "AND", "&&":
+				out = append(out, lexToken{kind: lexAnd})
+				continue
+			case "OR", "||":
+				out = append(out, lexToken{kind: lexOr})
+				continue
+			case "NOT":
+				out = append(out, lexToken{kind: lexNot})
+				continue
+			}
+			if k := strings.IndexRune(word, ':'); k > 0 && queryFields[strings.ToLower(word[:k])] {
+				out = append(out, lexToken{kind: lexField, text: strings.ToLower(word[:k])})
+				word = word[k+1:]
+				if word == "" {
+					continue
+				}
+			}
+			out = append(out, lexToken{kind: lexWord, text: word})
+		}
+	}
+	return out, nil
+}
+
+// -------------------------
+// Parser
+// -------------------------
+//
+//	query   := orExpr
+//	orExpr  := andExpr ( OR andExpr )*
+//	andExpr := unary ( [AND] unary )*
+//	unary   := ( NOT | '-' ) unary | primary
+//	primary := [field ':'] ( word | "phrase"[~N] | '(' orExpr ')' )
+
+type queryParser struct {
+	toks     []lexToken
+	pos      int
+	analyzer *Analyzer
+}
+
+// ParseQuery parses the search query language: implicit AND between terms,
+// OR, NOT or a leading '-' for exclusion, parentheses for grouping, quoted
+// phrases with optional ~N proximity, and title:/description:/tags:/
+// category:/type: qualifiers. It returns nil when the query has no
+// searchable terms. A query must match something before it excludes or
+// filters: one made only of exclusions or type: qualifiers, such as "-x",
+// "NOT foo" or "type:songs", is invalid.
+func ParseQuery(q string) (queryNode, error) {
+	return ParseQueryWith(q, defaultAnalyzer())
+}
+
+// ParseQueryWith is ParseQuery with words analysed by a.
+func ParseQueryWith(q string, a *Analyzer) (queryNode, error) {
+	toks, err := lexQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{toks: toks, analyzer: a}
+	node, err := p.parseOr("")
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("%w: unexpected %q", ErrInvalidQuery, p.describe(p.toks[p.pos]))
+	}
+	switch unanchored(node).(type) {
+	case nil:
+	case notNode:
+		return nil, fmt.Errorf("%w: NOT needs a term to exclude from", ErrInvalidQuery)
+	default:
+		return nil, fmt.Errorf("%w: type: needs a term to filter", ErrInvalidQuery)
+	}
+	return node, nil
+}
+
+// unanchored returns the first clause of node that would apply to every
+// indexed document rather than to the matches of a text clause: an exclusion
+// or a type: filter with no term beside it in an AND. It returns nil when
+// every clause is anchored.
+func unanchored(node queryNode) queryNode {
+	switch n := node.(type) {
+	case notNode, typeNode:
+		return n
+	case orNode:
+		for _, c := range n.children {
+			if u := unanchored(c); u != nil {
+				return u
+			}
+		}
+	case andNode:
+		var filter queryNode
+		positive := false
+		for _, c := range n.children {
+			if not, ok := c.(notNode); ok {
+				c = not.child
+			} else if !isTypeFilter(c) {
+				positive = true
+			}
+			if isTypeFilter(c) {
+				filter = c
+				continue
+			}
+			if u := unanchored(c); u != nil {
+				return u
+			}
+		}
+		if !positive {
+			if filter != nil {
+				return filter
+			}
+			return notNode{}
+		}
+	}
+	return nil
+}
+
+// isTypeFilter reports whether node only restricts entity types: a type:
+// qualifier or an OR of them.
+func isTypeFilter(node queryNode) bool {
+	switch n := node.(type) {
+	case typeNode:
+		return true
+	case orNode:
+		for _, c := range n.children {
+			if !isTypeFilter(c) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) peek() (lexToken, bool) {
+	if p.pos >= len(p.toks) {
+		return lexToken{}, false
+	}
+	return p.toks[p.pos], true
+}
+
+func (p *queryParser) describe(t lexToken) string {
+	switch t.kind {
+	case lexLParen:
+		return "("
+	case lexRParen:
+		return ")"
+	case lexAnd:
+		return "AND"
+	case lexOr:
+		return "OR"
+	case lexNot:
+		return "NOT"
+	case lexField:
+		return t.text + ":"
+	}
+	return t.text
+}
+
+func (p *queryParser) parseOr(field string) (queryNode, error) {
+	var children []queryNode
+	for {
+		n, err := p.parseAnd(field)
+		if err != nil {
+			return nil, err
+		}
+		if n != nil {
+			children = append(children, n)
+		}
+		t, ok := p.peek()
+		if !ok || t.kind != lexOr {
+			break
+		}
+		p.pos++
+	}
+	switch len(children) {
+	case 0:
+		return nil, nil
+	case 1:
+		return children[0], nil
+	}
+	return orNode{children: children}, nil
+}
+
+func (p *queryParser) parseAnd(field string) (queryNode, error) {
+	var children []queryNode
+	for {
+		t, ok := p.peek()
+		if !ok || t.kind == lexOr || t.kind == lexRParen {
+			break
+		}
+		if t.kind == lexAnd {
+			p.pos++
+			continue
+		}
+		n, err := p.parseUnary(field)
+		if err != nil {
+			return nil, err
+		}
+		if n != nil {
+			children = append(children, n)
+		}
+	}
+	switch len(children) {
+	case 0:
+		return nil, nil
+	case 1:
+		return children[0], nil
+	}
+	return andNode{children: children}, nil
+}
+
+func (p *queryParser) parseUnary(field string) (queryNode, error) {
+	t, _ := p.peek()
+	if t.kind == lexNot {
+		p.pos++
+		if _, ok := p.peek(); !ok {
+			return nil, fmt.Errorf("%w: NOT without operand", ErrInvalidQuery)
+		}
+		child, err := p.parseUnary(field)
+		if err != nil || child == nil {
+			return nil, err
+		}
+		return notNode{child: child}, nil
+	}
+	return p.parsePrimary(field)
+}
+
+func (p *queryParser) parsePrimary(field string) (queryNode, error) {
+	t, ok := p.peek()
+	if !ok {
+		return nil, nil
+	}
+	if t.kind == lexField {
+		p.pos++
+		if _, ok := p.peek(); !ok {
+			return nil, fmt.Errorf("%w: %s: without value", ErrInvalidQuery, t.text)
+		}
+		return p.parsePrimary(t.text)
+	}
+
+	p.pos++
+	switch t.kind {
+	case lexLParen:
+		n, err := p.parseOr(field)
+		if err != nil {
+			return nil, err
+		}
+		if c, ok := p.peek(); !ok || c.kind != lexRParen {
+			return nil, fmt.Errorf("%w: missing )", ErrInvalidQuery)
+		}
+		p.pos++
+		return n, nil
+	case lexRParen:
+		return nil, fmt.Errorf("%w: unexpected )", ErrInvalidQuery)
+	case lexPhrase:
+		return textNode(p.analyzer, field, t.text, t.slop, true), nil
+	case lexWord:
+		if field == "type" {
+			return typeNode{entityType: strings.ToLower(t.text)}, nil
+		}
+		return textNode(p.analyzer, field, t.text, 0, false), nil
+	}
+	return nil, fmt.Errorf("%w: unexpected %q", ErrInvalidQuery, p.describe(t))
+}
+
+// textNode analyses text with a and returns a term for a single token or a
+// phrase for several, so "farm-fresh" must match as written. Quoted text
+// keeps its stop words when the analyzer is configured to. Text made only
+// of stopwords yields nil.
+func textNode(a *Analyzer, field, text string, slop int, quoted bool) queryNode {
+	if field == "type" {
+		return typeNode{entityType: strings.ToLower(strings.TrimSpace(text))}
+	}
+	var tokens []Token
+	if quoted {
+		tokens = a.AnalyzePhrase(text)
+	} else {
+		tokens = a.AnalyzeQuery(text)
+	}
+	words := 0
+	for _, t := range tokens {
+		if !t.Stop {
+			words++
+		}
+	}
+	switch {
+	case words == 0:
+		return nil
+	case len(tokens) == 1:
+		return termNode{field: field, term: tokens[0].Term}
+	}
+	phrase := phraseQuery{slop: slop}
+	for _, t := range tokens {
+		phrase.terms = append(phrase.terms, t.Term)
+		phrase.offsets = append(phrase.offsets, t.Pos-tokens[0].Pos)
+		phrase.stops = append(phrase.stops, t.Stop)
+	}
+	return phraseNode{field: field, phrase: phrase}
+}
+
+// isSimpleQuery reports whether node is a plain bag of unqualified terms,
+// which GetIndexedResults and SearchWithHashtagBoost already handle.
+func isSimpleQuery(node queryNode) bool {
+	switch n := node.(type) {
+	case termNode:
+		return n.field == ""
+	case andNode:
+		for _, c := range n.children {
+			if t, ok := c.(termNode); !ok || t.field != "" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// -------------------------
+// Evaluation
+// -------------------------
+
+type idSet map[string]struct{}
+
+func newIDSet(ids []string) idSet {
+	s := make(idSet, len(ids))
+	for _, id := range ids {
+		s[id] = struct{}{}
+	}
+	return s
+}
+
+func (s idSet) intersect(o idSet) idSet {
+	if len(o) < len(s) {
+		s, o = o, s
+	}
+	out := make(idSet, len(s))
+	for id := range s {
+		if _, ok := o[id]; ok {
+			out[id] = struct{}{}
+		}
+	}
+	return out
+}
+
+func (s idSet) union(o idSet) idSet {
+	out := make(idSet, len(s)+len(o))
+	for id := range s {
+		out[id] = struct{}{}
+	}
+	for id := range o {
+		out[id] = struct{}{}
+	}
+	return out
+}
+
+func (s idSet) minus(o idSet) idSet {
+	out := make(idSet, len(s))
+	for id := range s {
+		if _, ok := o[id]; !ok {
+			out[id] = struct{}{}
+		}
+	}
+	return out
+}
+
+func (s idSet) list() []string {
+	out := make([]string, 0, len(s))
+	for id := range s {
+		out = append(out, id)
+	}
+	return out
+}
+
+// postingKey is the Redis key whose members are the documents matching a
+// term, optionally restricted to one field.
+func postingKey(field, term string) string {
+	if field == "" {
+		return invertedKey(term)
+	}
+	return termFreqKey(field, term)
+}
+
+// queryEvaluator resolves a query AST against postings fetched from Redis
+// in a single pipeline. created holds the creation time of the documents
+// found in the term postings, which are scored by it.
+type queryEvaluator struct {
+	ctx      context.Context
+	postings map[string]idSet
+	created  map[string]float64
+}
+
+// collectKeys lists every posting key the AST refers to.
+func collectKeys(node queryNode, keys map[string]bool) {
+	switch n := node.(type) {
+	case termNode:
+		keys[postingKey(n.field, n.term)] = true
+	case phraseNode:
+		for i, t := range n.phrase.terms {
+			if !n.phrase.isStop(i) {
+				keys[postingKey(n.field, t)] = true
+			}
+		}
+	case andNode:
+		for _, c := range n.children {
+			collectKeys(c, keys)
+		}
+	case orNode:
+		for _, c := range n.children {
+			collectKeys(c, keys)
+		}
+	case notNode:
+		collectKeys(n.child, keys)
+	}
+}
+
+// positiveTerms lists the terms that can contribute to relevance: every
+// term and phrase term not under a NOT.
+func positiveTerms(node queryNode, seen map[string]bool, out []string) []string {
+	add := func(t string) {
+		if !seen[t] {
+			seen[t] = true
+			out = append(out, t)
+		}
+	}
+	switch n := node.(type) {
+	case termNode:
+		add(n.term)
+	case phraseNode:
+		for i, t := range n.phrase.terms {
+			if !n.phrase.isStop(i) {
+				add(t)
+			}
+		}
+	case andNode:
+		for _, c := range n.children {
+			out = positiveTerms(c, seen, out)
+		}
+	case orNode:
+		for _, c := range n.children {
+			out = positiveTerms(c, seen, out)
+		}
+	}
+	return out
+}
+
+func newQueryEvaluator(ctx context.Context, node queryNode) (*queryEvaluator, error) {
+	keys := map[string]bool{}
+	collectKeys(node, keys)
+
+	pipe := globals.RedisClient.Pipeline()
+	cmds := make(map[string]*redis.StringSliceCmd, len(keys))
+	scored := make(map[string]*redis.ZSliceCmd, len(keys))
+	for k := range keys {
+		switch {
+		case strings.HasPrefix(k, "tf:"):
+			cmds[k] = pipe.HKeys(ctx, k)
+		default:
+			scored[k] = pipe.ZRangeWithScores(ctx, k, 0, -1)
+		}
+	}
+	if len(keys) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+			return nil, err
+		}
+	}
+
+	ev := &queryEvaluator{ctx: ctx, postings: make(map[string]idSet, len(keys)), created: map[string]float64{}}
+	for k, c := range cmds {
+		ev.postings[k] = newIDSet(c.Val())
+	}
+	for k, c := range scored {
+		set := make(idSet, len(c.Val()))
+		for _, z := range c.Val() {
+			id, _ := z.Member.(string)
+			set[id] = struct{}{}
+			ev.created[id] = z.Score
+		}
+		ev.postings[k] = set
+	}
+	return ev, nil
+}
+
+func (ev *queryEvaluator) eval(node queryNode) (idSet, error) {
+	switch n := node.(type) {
+	case nil:
+		return idSet{}, nil
+	case termNode:
+		return ev.postings[postingKey(n.field, n.term)], nil
+	case typeNode:
+		// ParseQuery only accepts type: as a filter inside an AND with a
+		// text clause, which applies it below.
+		return nil, fmt.Errorf("%w: type: needs a term to filter", ErrInvalidQuery)
+	case phraseNode:
+		var set idSet
+		for i, t := range n.phrase.terms {
+			if n.phrase.isStop(i) {
+				continue
+			}
+			p := ev.postings[postingKey(n.field, t)]
+			if set == nil {
+				set = p
+			} else {
+				set = set.intersect(p)
+			}
+		}
+		fields := indexedFields
+		if n.field != "" {
+			fields = []string{n.field}
+		}
+		ids, err := filterPhraseMatches(ev.ctx, n.phrase, fields, set.list())
+		if err != nil {
+			return nil, err
+		}
+		return newIDSet(ids), nil
+	case orNode:
+		out := idSet{}
+		for _, c := range n.children {
+			s, err := ev.eval(c)
+			if err != nil {
+				return nil, err
+			}
+			out = out.union(s)
+		}
+		return out, nil
+	case andNode:
+		var out idSet
+		var excluded, filters []queryNode
+		for _, c := range n.children {
+			if not, ok := c.(notNode); ok {
+				excluded = append(excluded, not.child)
+				continue
+			}
+			if isTypeFilter(c) {
+				filters = append(filters, c)
+				continue
+			}
+			s, err := ev.eval(c)
+			if err != nil {
+				return nil, err
+			}
+			if out == nil {
+				out = s
+			} else {
+				out = out.intersect(s)
+			}
+		}
+		if out == nil {
+			return nil, fmt.Errorf("%w: NOT needs a term to exclude from", ErrInvalidQuery)
+		}
+		for _, f := range filters {
+			s, err := ev.ofTypes(out, f)
+			if err != nil {
+				return nil, err
+			}
+			out = s
+		}
+		for _, c := range excluded {
+			var s idSet
+			var err error
+			if isTypeFilter(c) {
+				s, err = ev.ofTypes(out, c)
+			} else {
+				s, err = ev.eval(c)
+			}
+			if err != nil {
+				return nil, err
+			}
+			out = out.minus(s)
+		}
+		return out, nil
+	case notNode:
+		// ParseQuery only accepts exclusions inside an AND with a positive
+		// clause, which handles them above.
+		return nil, fmt.Errorf("%w: NOT needs a term to exclude from", ErrInvalidQuery)
+	}
+	return nil, fmt.Errorf("unknown query node %T", node)
+}
+
+// ofTypes returns the members of set whose entity type is named by the
+// type filter f. Only set is looked up in the typesets, so a filter costs as
+// much as the text it narrows rather than the size of the type.
+func (ev *queryEvaluator) ofTypes(set idSet, f queryNode) (idSet, error) {
+	out := idSet{}
+	for _, t := range filterTypes(f, nil) {
+		ids, err := keepType(ev.ctx, set.list(), t)
+		if err != nil {
+			return nil, err
+		}
+		out = out.union(newIDSet(ids))
+	}
+	return out, nil
+}
+
+// filterTypes lists the entity types a type filter names.
+func filterTypes(f queryNode, out []string) []string {
+	switch n := f.(type) {
+	case typeNode:
+		out = append(out, n.entityType)
+	case orNode:
+		for _, c := range n.children {
+			out = filterTypes(c, out)
+		}
+	}
+	return out
+}
+
+// newestFirst lists set newest first. Documents matched only through
+// field postings have no known creation time and come last.
+func (ev *queryEvaluator) newestFirst(set idSet) []string {
+	ids := set.list()
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := ids[i], ids[j]
+		if ev.created[a] != ev.created[b] {
+			return ev.created[a] > ev.created[b]
+		}
+		return a < b
+	})
+	return ids
+}
+
+// byUpperBound lists set by the highest score each document could reach
+// through the tokens it contains, then newest first, so the candidates
+// scored under maxRankedCandidates are the ones that can rank highest: a
+// document containing a rare term comes before documents containing only
+// common ones. bounds holds the bm25MaxScore of each token.
+func (ev *queryEvaluator) byUpperBound(set idSet, bounds map[string]float64) []string {
+	type tokenPostings struct {
+		bound float64
+		sets  []idSet
+	}
+	var tps []tokenPostings
+	for t, b := range bounds {
+		tp := tokenPostings{bound: b}
+		for _, f := range append([]string{""}, indexedFields...) {
+			if p, ok := ev.postings[postingKey(f, t)]; ok {
+				tp.sets = append(tp.sets, p)
+			}
+		}
+		tps = append(tps, tp)
+	}
+	best := make(map[string]float64, len(set))
+	for id := range set {
+		for _, tp := range tps {
+			for _, p := range tp.sets {
+				if _, ok := p[id]; ok {
+					best[id] += tp.bound
+					break
+				}
+			}
+		}
+	}
+
+	ids := ev.newestFirst(set)
+	sort.SliceStable(ids, func(i, j int) bool { return best[ids[i]] > best[ids[j]] })
+	return ids
+}
+
+// evaluateQuery resolves node with set operations over the postings, keeps
+// the matches of entityType unless it is empty and ranks them by relevance
+// to the non-excluded terms, each scaled by its entry in boosts if any.
+func evaluateQuery(ctx context.Context, entityType string, node queryNode, boosts map[string]float64, limit int) ([]string, error) {
+	log.Printf("[evaluateQuery] START node=%+v limit=%d", node, limit)
+	ev, err := newQueryEvaluator(ctx, node)
+	if err != nil {
+		return nil, err
+	}
+	matched, err := ev.eval(node)
+	if err != nil {
+		return nil, err
+	}
+	if len(matched) == 0 {
+		log.Println("[evaluateQuery] No matches, returning nil")
+		return nil, nil
+	}
+
+	tokens := positiveTerms(node, map[string]bool{}, nil)
+	docFreqs, err := documentFrequencies(ctx, tokens)
+	if err != nil {
+		return nil, err
+	}
+	stats, err := getCorpusStats(ctx)
+	if err != nil {
+		return nil, err
+	}
+	bounds := make(map[string]float64, len(tokens))
+	for _, t := range tokens {
+		boost, ok := boosts[t]
+		if !ok {
+			boost = 1
+		}
+		bounds[t] = bm25MaxScore(bm25IDF(stats.docCount, docFreqs[t]), boost)
+	}
+	ids, err := keepType(ctx, ev.byUpperBound(matched, bounds), entityType)
+	if err != nil {
+		return nil, err
+	}
+	ids, err = rankByRelevance(ctx, tokens, docFreqs, boosts, ids)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && len(ids) > limit {
+		ids = ids[:limit]
+	}
+	log.Printf("[evaluateQuery] END IDs=%d", len(ids))
+	return ids, nil
+}
+
+// documentFrequencies returns the posting list size of every token.
+func documentFrequencies(ctx context.Context, tokens []string) (map[string]int, error) {
+	out := make(map[string]int, len(tokens))
+	if len(tokens) == 0 {
+		return out, nil
+	}
+	pipe := globals.RedisClient.Pipeline()
+	cmds := make([]*redis.IntCmd, len(tokens))
+	for i, t := range tokens {
+		cmds[i] = pipe.ZCard(ctx, invertedKey(t))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	for i, t := range tokens {
+		out[t] = int(cmds[i].Val())
+	}
+	return out, nil
+}
@@ -0,0 +1,123 @@
+package search
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		in   string
+		want queryNode
+	}{
+		{"", nil},
+		{"   ", nil},
+		{"Farm", termNode{term: "farm"}},
+		{"café", termNode{term: "cafe"}},
+		{"farm eggs", andNode{children: []queryNode{termNode{term: "farm"}, termNode{term: "eggs"}}}},
+		{"farm AND eggs", andNode{children: []queryNode{termNode{term: "farm"}, termNode{term: "eggs"}}}},
+		{"farm && eggs", andNode{children: []queryNode{termNode{term: "farm"}, termNode{term: "eggs"}}}},
+		{"farm OR ranch", orNode{children: []queryNode{termNode{term: "farm"}, termNode{term: "ranch"}}}},
+		{"farm || ranch eggs", orNode{children: []queryNode{
+			termNode{term: "farm"},
+			andNode{children: []queryNode{termNode{term: "ranch"}, termNode{term: "eggs"}}},
+		}}},
+		{"farm -eggs", andNode{children: []queryNode{termNode{term: "farm"}, notNode{child: termNode{term: "eggs"}}}}},
+		{"farm NOT eggs", andNode{children: []queryNode{termNode{term: "farm"}, notNode{child: termNode{term: "eggs"}}}}},
+		{"(farm OR ranch) eggs", andNode{children: []queryNode{
+			orNode{children: []queryNode{termNode{term: "farm"}, termNode{term: "ranch"}}},
+			termNode{term: "eggs"},
+		}}},
+		{"Title:Tea", termNode{field: FieldTitle, term: "tea"}},
+		{"tags:(farm OR ranch)", orNode{children: []queryNode{
+			termNode{field: FieldTags, term: "farm"},
+			termNode{field: FieldTags, term: "ranch"},
+		}}},
+		{"type:Songs tea", andNode{children: []queryNode{typeNode{entityType: "songs"}, termNode{term: "tea"}}}},
+		{"tea (type:songs OR type:users) -type:feedposts", andNode{children: []queryNode{
+			termNode{term: "tea"},
+			orNode{children: []queryNode{typeNode{entityType: "songs"}, typeNode{entityType: "users"}}},
+			notNode{child: typeNode{entityType: "feedposts"}},
+		}}},
+		{"unknown:tea", phraseNode{phrase: phraseQuery{
+			terms: []string{"unknown", "tea"}, offsets: []int{0, 1}, stops: []bool{false, false},
+		}}},
+		{`"fresh eggs"~2`, phraseNode{phrase: phraseQuery{
+			terms: []string{"fresh", "eggs"}, offsets: []int{0, 1}, stops: []bool{false, false}, slop: 2,
+		}}},
+		{"farm-fresh", phraseNode{phrase: phraseQuery{
+			terms: []string{"farm", "fresh"}, offsets: []int{0, 1}, stops: []bool{false, false},
+		}}},
+		{"#東京", termNode{term: "#東京"}},
+	}
+	for _, tt := range tests {
+		got, err := ParseQueryWith(tt.in, analyzers[StandardAnalyzer])
+		if err != nil {
+			t.Errorf("ParseQueryWith(%q) error: %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseQueryWith(%q) = %#v, want %#v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseQueryInvalid(t *testing.T) {
+	tests := []string{
+		`"fresh eggs`,
+		"farm)",
+		"(farm eggs",
+		"farm NOT",
+		"title:",
+		// Queries made only of exclusions.
+		"-eggs",
+		"NOT eggs",
+		"-farm -eggs",
+		"-(farm eggs)",
+		"farm OR -eggs",
+		"farm -(-eggs)",
+		// Type filters without a term.
+		"type:songs",
+		"type:songs type:users",
+		"type:songs -eggs",
+		"farm OR type:songs",
+		"-type:songs",
+	}
+	for _, in := range tests {
+		got, err := ParseQueryWith(in, analyzers[StandardAnalyzer])
+		if !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("ParseQueryWith(%q) = %#v, %v, want ErrInvalidQuery", in, got, err)
+		}
+	}
+}
+
+func TestWhyNot(t *testing.T) {
+	node, err := ParseQueryWith("(farm OR ranch) eggs -duck", analyzers[StandardAnalyzer])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := &queryEvaluator{ctx: context.Background(), postings: map[string]idSet{
+		postingKey("", "farm"):  newIDSet([]string{"a", "b", "c"}),
+		postingKey("", "ranch"): newIDSet([]string{"d"}),
+		postingKey("", "eggs"):  newIDSet([]string{"a", "c", "d", "e"}),
+		postingKey("", "duck"):  newIDSet([]string{"c"}),
+	}}
+	tree, err := ev.matchTree(node, newIDSet([]string{"a", "b", "c", "d", "e"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		"a": "",
+		"d": "",
+		"b": "missing eggs",
+		"c": "excluded by -duck",
+		"e": "matches none of (farm OR ranch)",
+	}
+	for id, want := range tests {
+		if got := tree.whyNot(id); got != want {
+			t.Errorf("whyNot(%q) = %q, want %q", id, got, want)
+		}
+	}
+}
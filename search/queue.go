@@ -0,0 +1,219 @@
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"naevis/globals"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// -------------------------
+// Indexing queue
+// -------------------------
+
+// Indexing events are queued on a Redis Stream read by the IndexingGroup
+// consumer group. An entry stays pending until a consumer acknowledges it,
+// so events survive worker restarts; acknowledged entries are deleted to
+// keep the stream bounded by the backlog.
+const (
+	IndexingStream = "indexing:stream"
+	IndexingGroup  = "indexers"
+
+	// Stream entry fields: the raw event JSON and, for retried events, the
+	// JSON list of earlier failed attempts.
+	indexEventField    = "event"
+	indexAttemptsField = "attempts"
+)
+
+// Retry policy. A failed event waits retryBaseDelay, doubling per attempt
+// up to retryMaxDelay, and is dead-lettered after maxIndexAttempts.
+const (
+	maxIndexAttempts = 5
+	retryBaseDelay   = 2 * time.Second
+	retryMaxDelay    = 5 * time.Minute
+)
+
+func retryScheduleKey() string       { return "indexing:retry" }
+func retryEntryKey(id string) string { return "indexing:retry:" + id }
+
+// IndexAttempt is one failed attempt at indexing an event.
+type IndexAttempt struct {
+	At    time.Time `json:"at"`
+	Error string    `json:"error"`
+}
+
+// QueuedEvent is a stream entry: the raw event and its failed attempts.
+type QueuedEvent struct {
+	ID       string
+	Event    []byte
+	Attempts []IndexAttempt
+}
+
+// EnqueueIndexEvent appends the raw JSON of an indexing event to the
+// stream and returns its entry id once Redis has stored it.
+func EnqueueIndexEvent(ctx context.Context, body []byte) (string, error) {
+	return globals.RedisClient.XAdd(ctx, &redis.XAddArgs{
+		Stream: IndexingStream,
+		Values: map[string]interface{}{indexEventField: body},
+	}).Result()
+}
+
+// EnsureIndexingGroup creates the stream and its consumer group if they do
+// not exist yet. A new group starts at the beginning of the stream so
+// entries queued before any worker ran are not skipped.
+func EnsureIndexingGroup(ctx context.Context) error {
+	err := globals.RedisClient.XGroupCreateMkStream(ctx, IndexingStream, IndexingGroup, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	return nil
+}
+
+// ParseIndexEntry reads a stream entry.
+func ParseIndexEntry(msg redis.XMessage) (QueuedEvent, error) {
+	e := QueuedEvent{ID: msg.ID}
+	v, ok := msg.Values[indexEventField].(string)
+	if !ok {
+		return e, errors.New("stream entry " + msg.ID + " has no event")
+	}
+	e.Event = []byte(v)
+	if a, ok := msg.Values[indexAttemptsField].(string); ok && a != "" {
+		if err := json.Unmarshal([]byte(a), &e.Attempts); err != nil {
+			return e, err
+		}
+	}
+	return e, nil
+}
+
+// AckIndexEvent acknowledges processed entries and removes them from the
+// stream.
+func AckIndexEvent(ctx context.Context, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	pipe := globals.RedisClient.TxPipeline()
+	pipe.XAck(ctx, IndexingStream, IndexingGroup, ids...)
+	pipe.XDel(ctx, IndexingStream, ids...)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// retryDelay returns the wait before attempt n+1 after n failures.
+func retryDelay(n int) time.Duration {
+	d := retryBaseDelay
+	for i := 1; i < n && d < retryMaxDelay; i++ {
+		d *= 2
+	}
+	return min(d, retryMaxDelay)
+}
+
+// FailIndexEvent records a failed attempt at e and, in one transaction,
+// acknowledges its entry and either schedules a retry or dead-letters it
+// once maxIndexAttempts is reached. It reports whether e was dead-lettered.
+func FailIndexEvent(ctx context.Context, e QueuedEvent, cause error) (bool, error) {
+	now := time.Now().UTC()
+	e.Attempts = append(e.Attempts, IndexAttempt{At: now, Error: cause.Error()})
+	attempts, err := json.Marshal(e.Attempts)
+	if err != nil {
+		return false, err
+	}
+
+	pipe := globals.RedisClient.TxPipeline()
+	dead := len(e.Attempts) >= maxIndexAttempts
+	if dead {
+		if err := deadLetterPipeline(ctx, pipe, e, now); err != nil {
+			return false, err
+		}
+	} else {
+		next := now.Add(retryDelay(len(e.Attempts)))
+		pipe.HSet(ctx, retryEntryKey(e.ID), indexEventField, e.Event, indexAttemptsField, attempts)
+		pipe.ZAdd(ctx, retryScheduleKey(), redis.Z{Score: float64(next.UnixMilli()), Member: e.ID})
+	}
+	pipe.XAck(ctx, IndexingStream, IndexingGroup, e.ID)
+	pipe.XDel(ctx, IndexingStream, e.ID)
+	_, err = pipe.Exec(ctx)
+	return dead, err
+}
+
+// promoteRetriesScript moves up to ARGV[2] retries due by ARGV[1] back onto
+// the stream, atomically so that no retry is lost or queued twice.
+var promoteRetriesScript = redis.NewScript(`
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, id in ipairs(due) do
+	local key = KEYS[1] .. ':' .. id
+	local entry = redis.call('HMGET', key, 'event', 'attempts')
+	if entry[1] then
+		redis.call('XADD', KEYS[2], '*', 'event', entry[1], 'attempts', entry[2] or '')
+	end
+	redis.call('DEL', key)
+	redis.call('ZREM', KEYS[1], id)
+end
+return #due
+`)
+
+// PromoteDueRetries requeues the failed events whose backoff has elapsed
+// and returns how many it requeued.
+func PromoteDueRetries(ctx context.Context, limit int) (int, error) {
+	n, err := promoteRetriesScript.Run(ctx, globals.RedisClient,
+		[]string{retryScheduleKey(), IndexingStream},
+		strconv.FormatInt(time.Now().UnixMilli(), 10), limit).Int()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	return n, err
+}
+
+// QueueStats describes the indexing backlog. Length counts the entries not
+// yet acknowledged, of which Pending were delivered to a worker and
+// Undelivered were not; LagMs is the age of the oldest of them. Retrying
+// and DeadLetters count the failed events waiting for a retry or given up.
+type QueueStats struct {
+	Length      int64 `json:"length"`
+	Pending     int64 `json:"pending"`
+	Undelivered int64 `json:"undelivered"`
+	LagMs       int64 `json:"lag_ms"`
+	Retrying    int64 `json:"retrying"`
+	DeadLetters int64 `json:"dead_letters"`
+}
+
+// IndexingQueueStats reads the state of the indexing stream and its
+// consumer group.
+func IndexingQueueStats(ctx context.Context) (QueueStats, error) {
+	var s QueueStats
+	pipe := globals.RedisClient.Pipeline()
+	length := pipe.XLen(ctx, IndexingStream)
+	oldest := pipe.XRangeN(ctx, IndexingStream, "-", "+", 1)
+	groups := pipe.XInfoGroups(ctx, IndexingStream)
+	retrying := pipe.ZCard(ctx, retryScheduleKey())
+	dead := pipe.ZCard(ctx, deadLetterOrderKey())
+	// XINFO fails until the stream exists; the other counts are still valid.
+	_, _ = pipe.Exec(ctx)
+	for _, c := range []redis.Cmder{length, oldest, retrying, dead} {
+		if err := c.Err(); err != nil && !errors.Is(err, redis.Nil) {
+			return s, err
+		}
+	}
+
+	s.Length = length.Val()
+	s.Retrying = retrying.Val()
+	s.DeadLetters = dead.Val()
+	for _, g := range groups.Val() {
+		if g.Name == IndexingGroup {
+			s.Pending = g.Pending
+			s.Undelivered = max(s.Length-g.Pending, 0)
+		}
+	}
+	if msgs := oldest.Val(); len(msgs) > 0 {
+		ms, _, _ := strings.Cut(msgs[0].ID, "-")
+		if t, err := strconv.ParseInt(ms, 10, 64); err == nil {
+			s.LagMs = max(time.Now().UnixMilli()-t, 0)
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,110 @@
+package search
+
+import (
+	"net/http"
+	"time"
+
+	"naevis/utils"
+)
+
+// -------------------------
+// Response envelope
+// -------------------------
+
+// ResponseVersion is bumped on incompatible changes to the envelope.
+const ResponseVersion = "1"
+
+// Response and error codes.
+const (
+	CodeOK                = "ok"
+	CodeNoResults         = "no_results"
+	CodeMissingQuery      = "missing_query"
+	CodeInvalidQuery      = "invalid_query"
+	CodeInvalidCursor     = "invalid_cursor"
+	CodeInvalidParameter  = "invalid_parameter"
+	CodeUnknownEntityType = "unknown_entity_type"
+	CodeNotFound          = "not_found"
+	CodeInternal          = "internal_error"
+)
+
+// ResponseMeta is shared by every search response.
+type ResponseMeta struct {
+	Version string `json:"version"`
+	Code    string `json:"code"`
+	Query   string `json:"query"`
+	// Tokens are the query terms after analysis, before synonym and fuzzy
+	// expansion.
+	Tokens  []string          `json:"tokens"`
+	Filters map[string]string `json:"filters"`
+	Total   int               `json:"total"`
+	TookMs  int64             `json:"took_ms"`
+	// Suggestion is a spelling correction offered when nothing matched;
+	// CorrectedQuery is set instead when it was run in place of the query.
+	Suggestion     string `json:"suggestion,omitempty"`
+	CorrectedQuery string `json:"corrected_query,omitempty"`
+}
+
+// TypeSearchResponse is the body of GET /api/v1/search/:entityType.
+type TypeSearchResponse struct {
+	ResponseMeta
+	EntityType string  `json:"entity_type"`
+	Hits       []Hit   `json:"hits"`
+	Offset     int     `json:"offset"`
+	Limit      int     `json:"limit"`
+	NextCursor string  `json:"next_cursor,omitempty"`
+	Facets     []Facet `json:"facets,omitempty"`
+}
+
+// UnifiedSearchResponse is the body of GET /api/v1/search.
+type UnifiedSearchResponse struct {
+	ResponseMeta
+	Groups []SearchGroup `json:"groups"`
+	Facets []Facet       `json:"facets,omitempty"`
+}
+
+// ErrorResponse is the body of every failed search request.
+type ErrorResponse struct {
+	Version string    `json:"version"`
+	Error   ErrorBody `json:"error"`
+}
+
+type ErrorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func newResponseMeta(query string, tokens []string, total int, start time.Time) ResponseMeta {
+	m := ResponseMeta{
+		Version: ResponseVersion,
+		Code:    CodeOK,
+		Query:   query,
+		Tokens:  tokens,
+		Filters: map[string]string{},
+		Total:   total,
+		TookMs:  time.Since(start).Milliseconds(),
+	}
+	if m.Tokens == nil {
+		m.Tokens = []string{}
+	}
+	if total == 0 {
+		m.Code = CodeNoResults
+	}
+	return m
+}
+
+func writeSearchError(w http.ResponseWriter, status int, code, message string) {
+	utils.RespondWithJSON(w, status, ErrorResponse{
+		Version: ResponseVersion,
+		Error:   ErrorBody{Code: code, Message: message},
+	})
+}
+
+// queryTokens returns the analysed terms of query for entityType, as
+// matched against the index.
+func queryTokens(entityType, query string) []string {
+	node, err := ParseQueryWith(query, searchAnalyzerFor(entityType))
+	if err != nil || node == nil {
+		return []string{}
+	}
+	return positiveTerms(node, map[string]bool{}, nil)
+}
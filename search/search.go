@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"log"
 	"reflect"
-	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -35,19 +34,39 @@ type Entity struct {
 	Image       string    `json:"image" bson:"image"`
 	Description string    `json:"description" bson:"description"`
 	CreatedAt   time.Time `json:"createdAt" bson:"createdAt"`
+	// Fields holds extra searchable text keyed by field name (tags,
+	// category); see indexedFields.
+	Fields map[string]string `json:"fields,omitempty" bson:"fields,omitempty"`
+	// Language selects a language-specific analyzer; see analyzerFor.
+	Language string `json:"language,omitempty" bson:"language,omitempty"`
+	// Facets holds the facetable attribute values keyed by facet name; see
+	// facetNames.
+	Facets map[string][]string `json:"facets,omitempty" bson:"facets,omitempty"`
+	// Price and Status are filter attributes; see AttributeFilters.
+	Price  *float64 `json:"price,omitempty" bson:"price,omitempty"`
+	Status string   `json:"status,omitempty" bson:"status,omitempty"`
+	// Sort keys; see sortOrders. Popularity is the source's own measure
+	// (plays, views, followers, likes); Date is when an event takes place.
+	Popularity int64      `json:"popularity,omitempty" bson:"popularity,omitempty"`
+	Rating     *float64   `json:"rating,omitempty" bson:"rating,omitempty"`
+	Wage       *float64   `json:"wage,omitempty" bson:"wage,omitempty"`
+	Date       *time.Time `json:"date,omitempty" bson:"date,omitempty"`
 }
 
 // -------------------------
 // Mongo helpers
 // -------------------------
 
+// SaveEntityToDB stores entity in place of its previous version. The whole
+// document is replaced, so attributes the source no longer has (a price, a
+// status, a date) are dropped instead of lingering in filters.
 func SaveEntityToDB(ctx context.Context, entity Entity) error {
 	log.Printf("[SaveEntityToDB] START entity=%+v", entity)
-	coll := globals.MongoClient.Database("naevis").Collection("search")
-	_, err := coll.UpdateOne(ctx,
+	coll := db.Client.Database("naevis").Collection("search")
+	_, err := coll.ReplaceOne(ctx,
 		bson.M{"entityid": entity.EntityID, "entitytype": entity.EntityType},
-		bson.M{"$set": entity},
-		options.Update().SetUpsert(true),
+		entity,
+		options.Replace().SetUpsert(true),
 	)
 	log.Printf("[SaveEntityToDB] END err=%v", err)
 	return err
@@ -56,7 +75,7 @@ func SaveEntityToDB(ctx context.Context, entity Entity) error {
 func FetchEntityFromSearchDB(ctx context.Context, id string) (Entity, error) {
 	log.Printf("[FetchEntityFromSearchDB] START id=%q", id)
 	var ent Entity
-	err := globals.MongoClient.Database("naevis").Collection("search").
+	err := db.Client.Database("naevis").Collection("search").
 		FindOne(ctx, bson.M{"entityid": id}).Decode(&ent)
 	log.Printf("[FetchEntityFromSearchDB] END entity=%+v err=%v", ent, err)
 	return ent, err
@@ -64,17 +83,29 @@ func FetchEntityFromSearchDB(ctx context.Context, id string) (Entity, error) {
 
 func FetchAndDecode(ctx context.Context, collectionName string, filter bson.M, out interface{}) error {
 	log.Printf("[FetchAndDecode] START collection=%q filter=%v", collectionName, filter)
-	projection, exists := Projections[collectionName]
-	if !exists {
-		projection = bson.M{}
-	}
+	projection := projectionFor(collectionName)
 	log.Printf("[FetchAndDecode] projection=%v", projection)
 	opts := options.FindOne().SetProjection(projection)
-	err := globals.MongoClient.Database("eventdb").Collection(collectionName).FindOne(ctx, filter, opts).Decode(out)
+	err := db.Client.Database("eventdb").Collection(collectionName).FindOne(ctx, filter, opts).Decode(out)
 	log.Printf("[FetchAndDecode] END err=%v", err)
 	return err
 }
 
+// FetchAllAndDecode is FetchAndDecode for every document matching filter;
+// out must be a pointer to a slice.
+func FetchAllAndDecode(ctx context.Context, collectionName string, filter bson.M, out interface{}) error {
+	log.Printf("[FetchAllAndDecode] START collection=%q filter=%v", collectionName, filter)
+	opts := options.Find().SetProjection(projectionFor(collectionName))
+	cur, err := db.Client.Database("eventdb").Collection(collectionName).Find(ctx, filter, opts)
+	if err != nil {
+		log.Printf("[FetchAllAndDecode] END err=%v", err)
+		return err
+	}
+	err = cur.All(ctx, out)
+	log.Printf("[FetchAllAndDecode] END err=%v", err)
+	return err
+}
+
 // -------------------------
 // Search fetching
 // -------------------------
@@ -88,13 +119,14 @@ func fetchOne[T any](ctx context.Context, coll *mongo.Collection, idField string
 	return doc, err
 }
 
-func fetchResults[T any](ctx context.Context, query string, limit int, coll *mongo.Collection, entityType string) ([]T, error) {
-	ids, err := GetIndexResults(ctx, query, limit)
-	if err != nil || len(ids) == 0 {
-		return nil, err
+// fetchByIDs loads the documents of entityType with the given ids from
+// coll, in the order of ids. Ids that are missing or of another type are
+// skipped.
+func fetchByIDs[T any](ctx context.Context, ids []string, coll *mongo.Collection, entityType string) ([]T, error) {
+	if len(ids) == 0 {
+		return nil, nil
 	}
-
-	log.Println("[fetchResults] ids:", ids)
+	log.Println("[fetchByIDs] ids:", ids)
 
 	// Filter by both entityid and entitytype
 	filter := bson.M{
@@ -106,22 +138,20 @@ func fetchResults[T any](ctx context.Context, query string, limit int, coll *mon
 		return nil, err
 	}
 	defer cur.Close(ctx)
-	log.Println("[fetchResults] cursor:", cur)
 
 	var results []T
 	if err := cur.All(ctx, &results); err != nil {
 		return nil, err
 	}
-	log.Println("[fetchResults] results:", results)
+	log.Println("[fetchByIDs] results:", len(results))
 
 	// Preserve Redis order
 	idIndex := make(map[string]int, len(ids))
 	for i, id := range ids {
 		idIndex[fmt.Sprint(id)] = i
 	}
-	log.Println("[fetchResults] idIndex:", idIndex)
 
-	ordered := make([]T, len(results))
+	ordered := make([]T, len(ids))
 	count := 0
 	for _, doc := range results {
 		raw, _ := bson.Marshal(doc)
@@ -134,7 +164,6 @@ func fetchResults[T any](ctx context.Context, query string, limit int, coll *mon
 			}
 		}
 	}
-	log.Println("[fetchResults] ordered:", ordered)
 
 	final := make([]T, 0, count)
 	for _, doc := range ordered {
@@ -142,7 +171,7 @@ func fetchResults[T any](ctx context.Context, query string, limit int, coll *mon
 			final = append(final, doc)
 		}
 	}
-	log.Println("[fetchResults] final:", final)
+	log.Println("[fetchByIDs] final:", len(final))
 	return final, nil
 }
 
@@ -150,17 +179,23 @@ func isZero[T any](v T) bool {
 	return reflect.ValueOf(v).IsZero()
 }
 
+// searchableTypes are the entity types that can be searched.
+var searchableTypes = []string{
+	"songs", "users", "recipes", "products", "blogposts", "feedposts",
+	"places", "merch", "menu", "media", "farms", "events", "crops",
+	"baitoworkers", "baitos", "artists",
+}
+
 func GetResultsOfType(ctx context.Context, entityType, query string, limit int) (interface{}, error) {
 	log.Printf("entityType: %s, query: %s, limit: %d", entityType, query, limit)
-	allowedTypes := []string{
-		"songs", "users", "recipes", "products", "blogposts", "feedposts",
-		"places", "merch", "menu", "media", "farms", "events", "crops",
-		"baitoworkers", "baitos", "artists",
-	}
-	if !contains(allowedTypes, entityType) {
+	if !contains(searchableTypes, entityType) {
 		return nil, nil
 	}
-	return fetchResults[Entity](ctx, query, limit, db.Client.Database("naevis").Collection("search"), entityType)
+	page, err := SearchPageOfType(ctx, entityType, query, 0, limit, "", SearchOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return page.Results, nil
 }
 
 func contains(slice []string, s string) bool {
@@ -172,47 +207,92 @@ func contains(slice []string, s string) bool {
 	return false
 }
 
+// rawSource is the source collection of an event entity type and how to
+// decode its documents.
+type rawSource struct {
+	coll    **mongo.Collection
+	idField string
+	one     func(ctx context.Context, coll *mongo.Collection, idField, id string) (interface{}, error)
+	many    func(ctx context.Context, coll *mongo.Collection, idField string, ids []string) (map[string]interface{}, error)
+}
+
+func source[T any](coll **mongo.Collection, idField string) rawSource {
+	return rawSource{
+		coll:    coll,
+		idField: idField,
+		one: func(ctx context.Context, c *mongo.Collection, f, id string) (interface{}, error) {
+			return fetchOne[T](ctx, c, f, id)
+		},
+		many: fetchMany[T],
+	}
+}
+
+// rawSources maps the entity types of indexing events to their sources.
+var rawSources = map[string]rawSource{
+	"song":        source[models.ArtistSong](&db.SongsCollection, "songid"),
+	"user":        source[models.User](&db.UserCollection, "userid"),
+	"recipe":      source[models.Recipe](&db.RecipeCollection, "recipeid"),
+	"product":     source[models.Product](&db.ProductCollection, "productid"),
+	"blogpost":    source[models.BlogPost](&db.BlogPostsCollection, "postid"),
+	"place":       source[models.MPlace](&db.PlacesCollection, "placeid"),
+	"merch":       source[models.Merch](&db.MerchCollection, "merchid"),
+	"menu":        source[models.Menu](&db.MenuCollection, "menuid"),
+	"media":       source[models.Media](&db.MediaCollection, "mediaid"),
+	"farm":        source[models.Farm](&db.FarmsCollection, "farmid"),
+	"event":       source[models.MEvent](&db.EventsCollection, "eventid"),
+	"crop":        source[models.Crop](&db.CropsCollection, "cropid"),
+	"baitoworker": source[models.BaitoWorker](&db.BaitoWorkerCollection, "baito_user_id"),
+	"baito":       source[models.Baito](&db.BaitoCollection, "baitoid"),
+	"artist":      source[models.Artist](&db.ArtistsCollection, "artistid"),
+	"feedpost":    source[models.FeedPost](&db.PostsCollection, "postid"),
+}
+
+// fetchMany loads the documents with the given ids from coll, keyed by id.
+// Missing ids are left out.
+func fetchMany[T any](ctx context.Context, coll *mongo.Collection, idField string, ids []string) (map[string]interface{}, error) {
+	cur, err := coll.Find(ctx, bson.M{idField: bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	out := make(map[string]interface{}, len(ids))
+	for cur.Next(ctx) {
+		var doc T
+		if err := cur.Decode(&doc); err != nil {
+			return nil, err
+		}
+		if id, ok := cur.Current.Lookup(idField).StringValueOK(); ok {
+			out[id] = doc
+		}
+	}
+	return out, cur.Err()
+}
+
 func GetResultsByTypeRaw(ctx context.Context, entityType, id string) (interface{}, error) {
 	log.Printf("[GetResultsByTypeRaw] START entityType=%q id=%q", entityType, id)
 
-	switch entityType {
-	case "song":
-		return fetchOne[models.ArtistSong](ctx, db.SongsCollection, "songid", id)
-	case "user":
-		return fetchOne[models.User](ctx, db.UserCollection, "userid", id)
-	case "recipe":
-		return fetchOne[models.Recipe](ctx, db.RecipeCollection, "recipeid", id)
-	case "product":
-		return fetchOne[models.Product](ctx, db.ProductCollection, "productid", id)
-	case "blogpost":
-		return fetchOne[models.BlogPost](ctx, db.BlogPostsCollection, "postid", id)
-	case "place":
-		return fetchOne[models.MPlace](ctx, db.PlacesCollection, "placeid", id)
-	case "merch":
-		return fetchOne[models.Merch](ctx, db.MerchCollection, "merchid", id)
-	case "menu":
-		return fetchOne[models.Menu](ctx, db.MenuCollection, "menuid", id)
-	case "media":
-		return fetchOne[models.Media](ctx, db.MediaCollection, "mediaid", id)
-	case "farm":
-		return fetchOne[models.Farm](ctx, db.FarmsCollection, "farmid", id)
-	case "event":
-		return fetchOne[models.MEvent](ctx, db.EventsCollection, "eventid", id)
-	case "crop":
-		return fetchOne[models.Crop](ctx, db.CropsCollection, "cropid", id)
-	case "baitoworker":
-		return fetchOne[models.BaitoWorker](ctx, db.BaitoWorkerCollection, "baito_user_id", id)
-	case "baito":
-		return fetchOne[models.Baito](ctx, db.BaitoCollection, "baitoid", id)
-	case "artist":
-		return fetchOne[models.Artist](ctx, db.ArtistsCollection, "artistid", id)
-	case "feedpost":
-		return fetchOne[models.FeedPost](ctx, db.PostsCollection, "postid", id)
-	default:
+	src, ok := rawSources[entityType]
+	if !ok {
 		err := fmt.Errorf("unsupported entity type: %s", entityType)
 		log.Printf("[GetResultsByTypeRaw] ERROR %v", err)
 		return nil, err
 	}
+	return src.one(ctx, *src.coll, src.idField, id)
+}
+
+// GetResultsByTypeRawBatch is GetResultsByTypeRaw for many ids in one
+// query, keyed by id. Missing ids are left out.
+func GetResultsByTypeRawBatch(ctx context.Context, entityType string, ids []string) (map[string]interface{}, error) {
+	log.Printf("[GetResultsByTypeRawBatch] START entityType=%q ids=%d", entityType, len(ids))
+
+	src, ok := rawSources[entityType]
+	if !ok {
+		err := fmt.Errorf("unsupported entity type: %s", entityType)
+		log.Printf("[GetResultsByTypeRawBatch] ERROR %v", err)
+		return nil, err
+	}
+	return src.many(ctx, *src.coll, src.idField, ids)
 }
 
 // -------------------------
@@ -226,26 +306,24 @@ func IndexEntity(ctx context.Context, entity Entity) error {
 		return fmt.Errorf("[IndexEntity] save entity to db: %w", err)
 	}
 
-	text := strings.TrimSpace(entity.Title + " " + entity.Description)
-	tokens := Tokenize(text)
-	log.Printf("[IndexEntity] tokens=%v", tokens)
+	terms := entityTerms(entity)
+	log.Printf("[IndexEntity] fieldTF=%v length=%d", terms.fieldTF, terms.length)
 
-	if len(tokens) == 0 {
+	if len(terms.tokens) == 0 {
 		log.Println("[IndexEntity] No tokens, skipping indexing")
 		return nil
 	}
 
-	pipe := globals.RedisClient.Pipeline()
-	for _, token := range tokens {
-		addToIndexPipeline(ctx, pipe, invertedKey(token), entity.EntityID, float64(entity.CreatedAt.UnixNano()))
-		if strings.HasPrefix(token, "#") {
-			addToIndexPipeline(ctx, pipe, hashtagKey(token), entity.EntityID, float64(entity.CreatedAt.UnixNano()))
-		}
-		pipe.ZAdd(ctx, autocompleteZSet(), redis.Z{Score: 0, Member: token})
-		log.Printf("[IndexEntity] Added token=%q to autocomplete zset", token)
+	meta, err := getDocMeta(ctx, entity.EntityID)
+	if err != nil {
+		return fmt.Errorf("[IndexEntity] read doc meta: %w", err)
 	}
 
-	_, err := pipe.Exec(ctx)
+	pipe := globals.RedisClient.TxPipeline()
+	removeDocStatsPipeline(ctx, pipe, entity.EntityID, meta)
+	indexDocPipeline(ctx, pipe, entity, terms)
+
+	_, err = pipe.Exec(ctx)
 	log.Printf("[IndexEntity] END err=%v", err)
 	return err
 }
@@ -258,22 +336,28 @@ func DeleteEntity(ctx context.Context, id string) error {
 		return err
 	}
 
-	tokens := Tokenize(ent.Title + " " + ent.Description)
-	log.Printf("[DeleteEntity] tokens=%v", tokens)
+	applied, err := appliedStopWords(ctx)
+	if err != nil {
+		log.Printf("[DeleteEntity] read applied stop words error=%v", err)
+		return err
+	}
+	terms := indexedTerms(ent, applied)
+	log.Printf("[DeleteEntity] tokens=%v", terms.tokenList())
 
-	pipe := globals.RedisClient.Pipeline()
-	for _, token := range tokens {
-		deleteFromIndexPipeline(ctx, pipe, invertedKey(token), id)
-		if strings.HasPrefix(token, "#") {
-			deleteFromIndexPipeline(ctx, pipe, hashtagKey(token), id)
-		}
+	meta, err := getDocMeta(ctx, id)
+	if err != nil {
+		log.Printf("[DeleteEntity] read doc meta error=%v", err)
+		return err
 	}
+
+	pipe := globals.RedisClient.TxPipeline()
+	unindexDocPipeline(ctx, pipe, id, terms, meta)
 	if _, err := pipe.Exec(ctx); err != nil {
 		log.Printf("[DeleteEntity] Redis pipeline error=%v", err)
 		return err
 	}
 
-	_, err = globals.MongoClient.Database("naevis").Collection("search").DeleteOne(ctx, bson.M{"entityid": id})
+	_, err = db.Client.Database("naevis").Collection("search").DeleteOne(ctx, bson.M{"entityid": id})
 	log.Printf("[DeleteEntity] END err=%v", err)
 	return err
 }
@@ -287,52 +371,30 @@ func UpdateEntityIndexes(ctx context.Context, newEntity Entity) error {
 		return IndexEntity(ctx, newEntity)
 	}
 
-	oldTokens := Tokenize(oldEnt.Title + " " + oldEnt.Description)
-	newTokens := Tokenize(newEntity.Title + " " + newEntity.Description)
-	log.Printf("[UpdateEntityIndexes] oldTokens=%v newTokens=%v", oldTokens, newTokens)
-
-	oldSet := make(map[string]struct{}, len(oldTokens))
-	newSet := make(map[string]struct{}, len(newTokens))
-	for _, t := range oldTokens {
-		oldSet[t] = struct{}{}
-	}
-	for _, t := range newTokens {
-		newSet[t] = struct{}{}
+	applied, err := appliedStopWords(ctx)
+	if err != nil {
+		log.Printf("[UpdateEntityIndexes] read applied stop words error=%v", err)
+		return err
 	}
+	// The old postings were written under the applied stop words, which
+	// differ from the configured ones until an apply has run.
+	oldTerms := indexedTerms(oldEnt, applied)
+	newTerms := entityTerms(newEntity)
+	log.Printf("[UpdateEntityIndexes] oldFieldTF=%v newFieldTF=%v", oldTerms.fieldTF, newTerms.fieldTF)
 
-	var toAdd, toRemove []string
-	for t := range oldSet {
-		if _, ok := newSet[t]; !ok {
-			toRemove = append(toRemove, t)
-		}
-	}
-	for t := range newSet {
-		if _, ok := oldSet[t]; !ok {
-			toAdd = append(toAdd, t)
-		}
+	meta, err := getDocMeta(ctx, newEntity.EntityID)
+	if err != nil {
+		log.Printf("[UpdateEntityIndexes] read doc meta error=%v", err)
+		return err
 	}
-	log.Printf("[UpdateEntityIndexes] toAdd=%v toRemove=%v", toAdd, toRemove)
 
-	if len(toAdd) == 0 && len(toRemove) == 0 {
+	if meta.indexed && meta.entityType == newEntity.EntityType && reflect.DeepEqual(oldTerms, newTerms) &&
+		sameAttributes(oldEnt, newEntity) {
 		log.Printf("[UpdateEntityIndexes] No changes, only updating DB")
 		return SaveEntityToDB(ctx, newEntity)
 	}
 
-	pipe := globals.RedisClient.Pipeline()
-	for _, token := range toRemove {
-		deleteFromIndexPipeline(ctx, pipe, invertedKey(token), newEntity.EntityID)
-		if strings.HasPrefix(token, "#") {
-			deleteFromIndexPipeline(ctx, pipe, hashtagKey(token), newEntity.EntityID)
-		}
-	}
-	for _, token := range toAdd {
-		addToIndexPipeline(ctx, pipe, invertedKey(token), newEntity.EntityID, float64(newEntity.CreatedAt.UnixNano()))
-		if strings.HasPrefix(token, "#") {
-			addToIndexPipeline(ctx, pipe, hashtagKey(token), newEntity.EntityID, float64(newEntity.CreatedAt.UnixNano()))
-		}
-		pipe.ZAdd(ctx, autocompleteZSet(), redis.Z{Score: 0, Member: token})
-	}
-	if _, err := pipe.Exec(ctx); err != nil {
+	if err := swapDocTerms(ctx, newEntity, oldTerms, newTerms, meta); err != nil {
 		log.Printf("[UpdateEntityIndexes] Redis pipeline error=%v", err)
 		return err
 	}
@@ -342,17 +404,71 @@ func UpdateEntityIndexes(ctx context.Context, newEntity Entity) error {
 	return err
 }
 
+// sameAttributes reports whether two versions of an entity have the same
+// facets, filter attributes and sort keys, which live in its docmeta.
+func sameAttributes(a, b Entity) bool {
+	return reflect.DeepEqual(a.Facets, b.Facets) && reflect.DeepEqual(a.Price, b.Price) && a.Status == b.Status &&
+		a.Popularity == b.Popularity && reflect.DeepEqual(a.Rating, b.Rating) && reflect.DeepEqual(a.Wage, b.Wage) &&
+		reflect.DeepEqual(a.Date, b.Date)
+}
+
+// reindexDocTerms replaces the postings of e, indexed as oldTerms, with
+// newTerms.
+func reindexDocTerms(ctx context.Context, e Entity, oldTerms, newTerms docTerms) error {
+	meta, err := getDocMeta(ctx, e.EntityID)
+	if err != nil {
+		return err
+	}
+	return swapDocTerms(ctx, e, oldTerms, newTerms, meta)
+}
+
+// swapDocTerms swaps old and new postings inside one transaction so readers
+// never see the entity half indexed.
+func swapDocTerms(ctx context.Context, e Entity, oldTerms, newTerms docTerms, meta docMeta) error {
+	pipe := globals.RedisClient.TxPipeline()
+	unindexDocPipeline(ctx, pipe, e.EntityID, oldTerms, meta)
+	if len(newTerms.tokens) > 0 {
+		indexDocPipeline(ctx, pipe, e, newTerms)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
 // -------------------------
 // Index data dispatcher
 // -------------------------
 
+// IndexDatainRedis applies an indexing event unless it is stale (see
+// ErrStaleEvent), then records its version.
 func IndexDatainRedis(ctx context.Context, event models.Index) error {
 	log.Printf("[IndexDatainRedis] START event=%+v", event)
 
+	last, err := getAppliedVersion(ctx, event)
+	if err != nil {
+		return err
+	}
+	if reason := staleReason(event, last); reason != "" {
+		log.Printf("[IndexDatainRedis] Skipping event: %s", reason)
+		return fmt.Errorf("%w: %s", ErrStaleEvent, reason)
+	}
+	if err := applyIndexEvent(ctx, event); err != nil {
+		return err
+	}
+	return recordAppliedVersion(ctx, event)
+}
+
+func applyIndexEvent(ctx context.Context, event models.Index) error {
 	switch strings.ToUpper(event.Method) {
 	case "DELETE":
 		log.Println("[IndexDatainRedis] Method=DELETE")
-		return DeleteEntity(ctx, event.EntityId)
+		err := DeleteEntity(ctx, event.EntityId)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			// Never indexed, or deleted already; the tombstone still has
+			// to reject a late create.
+			log.Println("[IndexDatainRedis] Entity not indexed, recording delete only")
+			return nil
+		}
+		return err
 
 	case "PATCH", "PUT":
 		log.Printf("[IndexDatainRedis] Method=%s", event.Method)
@@ -390,53 +506,89 @@ func IndexDatainRedis(ctx context.Context, event models.Index) error {
 func ConvertToEntity(ctx context.Context, data interface{}) (Entity, error) {
 	switch v := data.(type) {
 	case models.ArtistSong:
-		return Entity{EntityID: v.SongID, EntityType: "songs", Title: v.Title, Image: v.Poster, Description: v.Description, CreatedAt: parseTime(v.UploadedAt)}, nil
+		return Entity{EntityID: v.SongID, EntityType: "songs", Title: v.Title, Image: v.Poster, Description: v.Description, CreatedAt: parseTime(v.UploadedAt),
+			Fields: map[string]string{FieldCategory: v.Genre}, Language: v.Language,
+			Facets: newFacets(map[string][]string{FacetGenre: {v.Genre}}), Popularity: int64(v.Plays)}, nil
 	case models.User:
-		return Entity{EntityID: v.UserID, EntityType: "users", Title: v.Username, Image: v.ProfilePicture, Description: v.Bio, CreatedAt: parseTime(v.CreatedAt)}, nil
+		return Entity{EntityID: v.UserID, EntityType: "users", Title: v.Username, Image: v.ProfilePicture, Description: v.Bio, CreatedAt: parseTime(v.CreatedAt),
+			Popularity: int64(v.FollowersCount)}, nil
 	case models.Recipe:
 		var img string
 		if len(v.ImageURLs) > 0 {
 			img = v.ImageURLs[0]
 		}
-		return Entity{EntityID: v.RecipeId, EntityType: "recipes", Title: v.Title, Image: img, Description: v.Description, CreatedAt: parseTime(v.CreatedAt)}, nil
+		return Entity{EntityID: v.RecipeId, EntityType: "recipes", Title: v.Title, Image: img, Description: v.Description, CreatedAt: parseTime(v.CreatedAt),
+			Fields: map[string]string{FieldTags: joinField(v.Tags...)}, Facets: newFacets(map[string][]string{FacetTags: v.Tags}),
+			Popularity: int64(v.Views)}, nil
 	case models.Product:
 		var img string
 		if len(v.ImageURLs) > 0 {
 			img = v.ImageURLs[0]
 		}
-		return Entity{EntityID: v.ProductID, EntityType: "products", Title: v.Name, Image: img, Description: v.Description, CreatedAt: parseTime(v.CreatedAt)}, nil
+		return Entity{EntityID: v.ProductID, EntityType: "products", Title: v.Name, Image: img, Description: v.Description, CreatedAt: parseTime(v.CreatedAt),
+			Fields: map[string]string{FieldCategory: joinField(v.Category, v.Type)},
+			Facets: newFacets(map[string][]string{FacetCategory: {v.Category}, FacetSubcategory: {v.Type}}),
+			Price:  &v.Price, Status: stockStatus(v.Quantity)}, nil
 	case models.Menu:
-		return Entity{EntityID: v.MenuID, EntityType: "menu", Title: v.Name, Image: v.MenuPhoto, Description: v.Description, CreatedAt: parseTime(v.CreatedAt)}, nil
+		return Entity{EntityID: v.MenuID, EntityType: "menu", Title: v.Name, Image: v.MenuPhoto, Description: v.Description, CreatedAt: parseTime(v.CreatedAt),
+			Price: &v.Price, Status: stockStatus(v.Stock)}, nil
 	case models.Media:
-		return Entity{EntityID: v.MediaID, EntityType: "media", Title: v.Caption, Image: v.ThumbnailURL, Description: v.Caption, CreatedAt: parseTime(v.CreatedAt)}, nil
+		return Entity{EntityID: v.MediaID, EntityType: "media", Title: v.Caption, Image: v.ThumbnailURL, Description: v.Caption, CreatedAt: parseTime(v.CreatedAt),
+			Fields: map[string]string{FieldTags: joinField(v.Tags...)}, Facets: newFacets(map[string][]string{FacetTags: v.Tags}),
+			Popularity: int64(v.LikesCount)}, nil
 	case models.Crop:
-		return Entity{EntityID: v.CropId, EntityType: "crops", Title: v.Name, Image: v.ImageURL, Description: v.Category, CreatedAt: parseTime(v.CreatedAt)}, nil
+		status := stockStatus(v.Quantity)
+		if v.OutOfStock {
+			status = StatusOutOfStock
+		}
+		return Entity{EntityID: v.CropId, EntityType: "crops", Title: v.Name, Image: v.ImageURL, Description: v.Category, CreatedAt: parseTime(v.CreatedAt),
+			Facets: newFacets(map[string][]string{FacetCategory: {v.Category}}), Price: &v.Price, Status: status}, nil
 	case models.BaitoWorker:
-		return Entity{EntityID: v.BaitoUserID, EntityType: "baitoworkers", Title: v.Name, Image: v.ProfilePic, Description: v.Bio, CreatedAt: parseTime(v.CreatedAt)}, nil
+		return Entity{EntityID: v.BaitoUserID, EntityType: "baitoworkers", Title: v.Name, Image: v.ProfilePic, Description: v.Bio, CreatedAt: parseTime(v.CreatedAt),
+			Fields: map[string]string{FieldTags: v.Preferred}}, nil
 	case models.Artist:
-		return Entity{EntityID: v.ArtistID, EntityType: "artists", Title: v.Name, Image: v.Photo, Description: v.Bio, CreatedAt: parseTime(v.CreatedAt)}, nil
+		return Entity{EntityID: v.ArtistID, EntityType: "artists", Title: v.Name, Image: v.Photo, Description: v.Bio, CreatedAt: parseTime(v.CreatedAt),
+			Fields: map[string]string{FieldTags: joinField(v.Genres...), FieldCategory: v.Category},
+			Facets: newFacets(map[string][]string{FacetCategory: {v.Category}, FacetGenre: v.Genres})}, nil
 	case models.MEvent:
-		return Entity{EntityID: v.EventID, EntityType: "events", Title: v.Title, Image: v.Image, Description: v.Description, CreatedAt: parseTime(v.Date)}, nil
+		return Entity{EntityID: v.EventID, EntityType: "events", Title: v.Title, Image: v.Image, Description: v.Description, CreatedAt: parseTime(v.Date),
+			Fields: map[string]string{FieldCategory: v.Category}, Facets: newFacets(map[string][]string{FacetCategory: {v.Category}, FacetCity: {v.Location}}),
+			Date: optionalTime(v.Date)}, nil
 	case models.MPlace:
-		return Entity{EntityID: v.PlaceID, EntityType: "places", Title: v.Name, Image: v.Image, Description: v.Description, CreatedAt: parseTime(v.CreatedAt)}, nil
+		return Entity{EntityID: v.PlaceID, EntityType: "places", Title: v.Name, Image: v.Image, Description: v.Description, CreatedAt: parseTime(v.CreatedAt),
+			Fields: map[string]string{FieldCategory: v.Category}, Facets: newFacets(map[string][]string{FacetCategory: {v.Category}})}, nil
 	case models.BlogPost:
 		var img string
 		if len(v.ImagePaths) > 0 {
 			img = v.ImagePaths[0]
 		}
-		return Entity{EntityID: v.PostID, EntityType: "blogposts", Title: v.Title, Image: img, Description: v.Content, CreatedAt: parseTime(v.CreatedAt)}, nil
+		return Entity{EntityID: v.PostID, EntityType: "blogposts", Title: v.Title, Image: img, Description: v.Content, CreatedAt: parseTime(v.CreatedAt),
+			Fields: map[string]string{FieldCategory: joinField(v.Category, v.Subcategory)},
+			Facets: newFacets(map[string][]string{FacetCategory: {v.Category}, FacetSubcategory: {v.Subcategory}})}, nil
 	case models.Merch:
-		return Entity{EntityID: v.MerchID, EntityType: "merch", Title: v.Name, Image: v.MerchPhoto, Description: v.Category, CreatedAt: parseTime(v.CreatedAt)}, nil
+		status := normalizeStatus(v.StockStatus)
+		if status == "" {
+			status = stockStatus(v.Stock)
+		}
+		return Entity{EntityID: v.MerchID, EntityType: "merch", Title: v.Name, Image: v.MerchPhoto, Description: v.Category, CreatedAt: parseTime(v.CreatedAt),
+			Fields: map[string]string{FieldTags: joinField(v.Tags...)}, Facets: newFacets(map[string][]string{FacetCategory: {v.Category}, FacetTags: v.Tags}),
+			Price: &v.Price, Status: status, Rating: optionalFloat(v.Rating), Popularity: int64(v.ReviewCount)}, nil
 	case models.FeedPost:
 		var img string
 		if len(v.Media) > 0 {
 			img = v.Media[0]
 		}
-		return Entity{EntityID: v.PostID, EntityType: "feedposts", Title: v.Text, Image: img, Description: v.Content, CreatedAt: parseTime(v.CreatedAt)}, nil
+		return Entity{EntityID: v.PostID, EntityType: "feedposts", Title: v.Text, Image: img, Description: v.Content, CreatedAt: parseTime(v.CreatedAt),
+			Popularity: int64(v.Likes)}, nil
 	case models.Farm:
-		return Entity{EntityID: v.FarmID, EntityType: "farms", Title: v.Name, Image: v.Photo, Description: v.Description, CreatedAt: parseTime(v.CreatedAt)}, nil
+		return Entity{EntityID: v.FarmID, EntityType: "farms", Title: v.Name, Image: v.Photo, Description: v.Description, CreatedAt: parseTime(v.CreatedAt),
+			Fields: map[string]string{FieldTags: joinField(v.Tags...)}, Facets: newFacets(map[string][]string{FacetTags: v.Tags, FacetCity: {v.Location}}),
+			Rating: optionalFloat(v.AvgRating), Popularity: v.FavoritesCount}, nil
 	case models.Baito:
-		return Entity{EntityID: v.BaitoId, EntityType: "baitos", Title: v.Title, Image: v.BannerURL, Description: v.Description, CreatedAt: parseTime(v.CreatedAt)}, nil
+		return Entity{EntityID: v.BaitoId, EntityType: "baitos", Title: v.Title, Image: v.BannerURL, Description: v.Description, CreatedAt: parseTime(v.CreatedAt),
+			Fields: map[string]string{FieldCategory: joinField(v.Category, v.SubCategory)},
+			Facets: newFacets(map[string][]string{FacetCategory: {v.Category}, FacetSubcategory: {v.SubCategory}, FacetCity: {v.Location}}),
+			Wage:   parseWage(v.Wage)}, nil
 	case Entity:
 		return v, nil
 	case bson.M:
@@ -445,16 +597,101 @@ func ConvertToEntity(ctx context.Context, data interface{}) (Entity, error) {
 		title, _ := v["title"].(string)
 		desc, _ := v["description"].(string)
 		img, _ := v["image"].(string)
+		lang, _ := v["language"].(string)
 		created := time.Now()
 		if tval, ok := v["createdAt"]; ok {
 			created = parseTime(tval)
 		}
-		return Entity{EntityID: id, EntityType: typ, Title: title, Image: img, Description: desc, CreatedAt: created}, nil
+		var fields map[string]string
+		if fm, ok := v["fields"].(bson.M); ok {
+			fields = make(map[string]string, len(fm))
+			for k, fv := range fm {
+				if str, ok := fv.(string); ok {
+					fields[k] = str
+				}
+			}
+		}
+		var facets map[string][]string
+		if fm, ok := v["facets"].(bson.M); ok {
+			raw := make(map[string][]string, len(fm))
+			for k, fv := range fm {
+				if arr, ok := fv.(bson.A); ok {
+					for _, item := range arr {
+						if str, ok := item.(string); ok {
+							raw[k] = append(raw[k], str)
+						}
+					}
+				}
+			}
+			facets = newFacets(raw)
+		}
+		status, _ := v["status"].(string)
+		popularity, _ := bsonFloat(v["popularity"])
+		var date *time.Time
+		if d, ok := v["date"]; ok {
+			date = optionalTime(parseTime(d))
+		}
+		return Entity{EntityID: id, EntityType: typ, Title: title, Image: img, Description: desc, CreatedAt: created, Fields: fields, Language: lang,
+			Facets: facets, Price: bsonNumber(v["price"]), Status: status, Popularity: int64(popularity),
+			Rating: bsonNumber(v["rating"]), Wage: bsonNumber(v["wage"]), Date: date}, nil
 	default:
 		return Entity{}, fmt.Errorf("unsupported type %T", v)
 	}
 }
 
+// bsonFloat reads a BSON number of any width.
+func bsonFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+func bsonNumber(v interface{}) *float64 {
+	if n, ok := bsonFloat(v); ok {
+		return &n
+	}
+	return nil
+}
+
+// optionalFloat treats zero as unset, for source fields with omitempty.
+func optionalFloat(f float64) *float64 {
+	if f == 0 {
+		return nil
+	}
+	return &f
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// parseWage reads the amount of a free-form wage such as "¥1,200/hour"; it
+// is nil when there is none.
+func parseWage(s string) *float64 {
+	start := strings.IndexAny(s, "0123456789")
+	if start < 0 {
+		return nil
+	}
+	end := start
+	for end < len(s) && (s[end] >= '0' && s[end] <= '9' || s[end] == ',' || s[end] == '.') {
+		end++
+	}
+	n, err := strconv.ParseFloat(strings.ReplaceAll(s[start:end], ",", ""), 64)
+	if err != nil {
+		return nil
+	}
+	return &n
+}
+
 func parseTime(v interface{}) time.Time {
 	switch t := v.(type) {
 	case int:
@@ -495,7 +732,7 @@ func deleteFromIndexPipeline(ctx context.Context, pipe redis.Pipeliner, key, mem
 func GetIndexIDsForToken(ctx context.Context, token string) ([]string, error) {
 	log.Printf("[GetIndexIDsForToken] token=%q", token)
 	ids, err := globals.RedisClient.ZRevRange(ctx, invertedKey(token), 0, -1).Result()
-	log.Printf("[GetIndexIDsForToken] ids=%v err=%v", ids, err)
+	log.Printf("[GetIndexIDsForToken] ids=%d err=%v", len(ids), err)
 	return ids, err
 }
 
@@ -503,29 +740,26 @@ func GetIndexIDsForToken(ctx context.Context, token string) ([]string, error) {
 // Tokenization
 // -------------------------
 
-var tokenRegex = regexp.MustCompile(`(?i)(#\w+)|([A-Za-z0-9_]+)`)
-var stopWords = map[string]bool{
-	"the": true, "and": true, "of": true, "in": true, "to": true,
-	"for": true, "on": true, "with": true, "a": true, "an": true,
+// Tokenize returns the distinct query terms of text as analysed by the
+// standard analyzer.
+func Tokenize(text string) []string {
+	return tokenizeWith(defaultAnalyzer(), text)
 }
 
-func Tokenize(text string) []string {
-	log.Printf("[Tokenize] START text=%q", text)
+// tokenizeWith returns the distinct query-time terms of text for analyzer a,
+// in order of first appearance.
+func tokenizeWith(a *Analyzer, text string) []string {
+	log.Printf("[Tokenize] START analyzer=%s text=%q", a.Name, text)
 	if strings.TrimSpace(text) == "" {
 		log.Println("[Tokenize] Empty or whitespace-only input, returning nil")
 		return nil
 	}
-	matches := tokenRegex.FindAllString(text, -1)
-	log.Printf("[Tokenize] Raw matches=%v", matches)
+	tokens := a.AnalyzeQuery(text)
 
-	out := make([]string, 0, len(matches))
+	out := make([]string, 0, len(tokens))
 	seen := map[string]struct{}{}
-	for _, m := range matches {
-		t := strings.ToLower(m)
-		if stopWords[t] {
-			log.Printf("[Tokenize] Skipping stopword=%q", t)
-			continue
-		}
+	for _, tok := range tokens {
+		t := tok.Term
 		if _, ok := seen[t]; ok {
 			log.Printf("[Tokenize] Skipping duplicate=%q", t)
 			continue
@@ -539,6 +773,34 @@ func Tokenize(text string) []string {
 	return out
 }
 
+// fieldTerms is the index-time analysis of one field.
+type fieldTerms struct {
+	pos     map[string][]int // token -> positions
+	stopPos map[string][]int // stop word -> positions, for phrase checks
+	words   []string         // tokens as written, not derived by a filter
+	length  int              // in positions, so stacked stems do not count
+}
+
+// termPositions analyses text for indexing with a.
+func termPositions(a *Analyzer, text string) fieldTerms {
+	tokens := a.AnalyzeWithStops(text)
+	ft := fieldTerms{pos: make(map[string][]int, len(tokens)), stopPos: map[string][]int{}}
+	seen := make(map[int]struct{}, len(tokens))
+	for _, t := range tokens {
+		if t.Stop {
+			ft.stopPos[t.Term] = append(ft.stopPos[t.Term], t.Pos)
+			continue
+		}
+		if _, ok := ft.pos[t.Term]; !ok && !t.Derived {
+			ft.words = append(ft.words, t.Term)
+		}
+		ft.pos[t.Term] = append(ft.pos[t.Term], t.Pos)
+		seen[t.Pos] = struct{}{}
+	}
+	ft.length = len(seen)
+	return ft
+}
+
 func ExtractHashtags(text string) []string {
 	log.Printf("[ExtractHashtags] START text=%q", text)
 	tokens := Tokenize(text)
@@ -559,7 +821,12 @@ func ExtractHashtags(text string) []string {
 
 func GetIndexedResults(ctx context.Context, query string, limit int) ([]string, error) {
 	log.Printf("[GetIndexedResults] START query=%q limit=%d", query, limit)
-	tokens := Tokenize(query)
+	return getIndexedResults(ctx, "", Tokenize(query), limit)
+}
+
+// getIndexedResults returns the documents of entityType, or of any type
+// when it is empty, containing every token, ranked by BM25F.
+func getIndexedResults(ctx context.Context, entityType string, tokens []string, limit int) ([]string, error) {
 	if len(tokens) == 0 {
 		log.Println("[GetIndexedResults] No tokens, returning nil")
 		return nil, nil
@@ -593,6 +860,13 @@ func GetIndexedResults(ctx context.Context, query string, limit int) ([]string,
 		}
 	}
 
+	// The posting list sizes are the document frequencies BM25 needs; grab
+	// them before tl is reordered.
+	docFreqs := make(map[string]int, len(tokens))
+	for i, t := range tokens {
+		docFreqs[t] = len(tl[i].ids)
+	}
+
 	sort.Slice(tl, func(i, j int) bool { return len(tl[i].ids) < len(tl[j].ids) })
 	base := tl[0].ids
 	log.Printf("[GetIndexedResults] Base token IDs=%v", base)
@@ -606,7 +880,7 @@ func GetIndexedResults(ctx context.Context, query string, limit int) ([]string,
 		otherSets[i-1] = m
 	}
 
-	out := make([]string, 0, len(base))
+	matched := make([]string, 0, len(base))
 	for _, id := range base {
 		match := true
 		for _, s := range otherSets {
@@ -616,14 +890,27 @@ func GetIndexedResults(ctx context.Context, query string, limit int) ([]string,
 			}
 		}
 		if match {
-			out = append(out, id)
+			matched = append(matched, id)
 			log.Printf("[GetIndexedResults] Matched ID=%q", id)
-			if limit > 0 && len(out) >= limit {
-				break
-			}
 		}
 	}
 
+	matched, err := keepType(ctx, matched, entityType)
+	if err != nil {
+		return nil, err
+	}
+	// Matches are scored before the limit is applied, otherwise the most
+	// relevant documents could be cut off by newer ones; base keeps them
+	// newest first for the candidate cap.
+	out, err := rankBM25(ctx, tokens, docFreqs, matched)
+	if err != nil {
+		log.Printf("[GetIndexedResults] rankBM25 error: %v", err)
+		return nil, err
+	}
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+
 	log.Printf("[GetIndexedResults] END matchedIDs=%v", out)
 	return out, nil
 }
@@ -636,22 +923,41 @@ func SearchWithHashtagBoost(ctx context.Context, query string, limit int) ([]str
 		return nil, nil
 	}
 
-	tokens := Tokenize(query)
+	return searchWithHashtagBoost(ctx, "", Tokenize(query), limit)
+}
+
+// searchWithHashtagBoost returns the documents of entityType, or of any
+// type when it is empty, containing any token, scored +3 per matching token
+// and +7 more per matching hashtag.
+func searchWithHashtagBoost(ctx context.Context, entityType string, tokens []string, limit int) ([]string, error) {
 	if len(tokens) == 0 {
 		return nil, nil
 	}
-	hashtags := ExtractHashtags(query)
+	var hashtags []string
+	for _, t := range tokens {
+		if strings.HasPrefix(t, "#") {
+			hashtags = append(hashtags, t)
+		}
+	}
 
 	scoreMap := make(map[string]int)
+	docFreqs := make(map[string]int, len(tokens))
+	// recency ranks documents by their position in the first token's posting
+	// list, which is ordered newest-first.
+	recency := make(map[string]int)
 	log.Printf("[SearchWithHashtagBoost] Tokens=%v Hashtags=%v", tokens, hashtags)
 
-	for _, t := range tokens {
+	for i, t := range tokens {
 		ids, err := GetIndexIDsForToken(ctx, t)
 		if err != nil {
 			return nil, err
 		}
-		for _, id := range ids {
+		docFreqs[t] = len(ids)
+		for rank, id := range ids {
 			scoreMap[id] += 3
+			if i == 0 {
+				recency[id] = rank
+			}
 			log.Printf("[SearchWithHashtagBoost] Token %q added ID=%q score=+3 total=%d", t, id, scoreMap[id])
 		}
 	}
@@ -672,6 +978,26 @@ func SearchWithHashtagBoost(ctx context.Context, query string, limit int) ([]str
 		return nil, nil
 	}
 
+	if entityType != "" {
+		matched := make([]string, 0, len(scoreMap))
+		for id := range scoreMap {
+			matched = append(matched, id)
+		}
+		kept, err := keepType(ctx, matched, entityType)
+		if err != nil {
+			return nil, err
+		}
+		if len(kept) == 0 {
+			return nil, nil
+		}
+		keptSet := newIDSet(kept)
+		for id := range scoreMap {
+			if _, ok := keptSet[id]; !ok {
+				delete(scoreMap, id)
+			}
+		}
+	}
+
 	type pair struct {
 		id    string
 		score int
@@ -680,19 +1006,41 @@ func SearchWithHashtagBoost(ctx context.Context, query string, limit int) ([]str
 	for id, sc := range scoreMap {
 		pairs = append(pairs, pair{id: id, score: sc})
 	}
-
-	sort.Slice(pairs, func(i, j int) bool {
-		if pairs[i].score != pairs[j].score {
-			return pairs[i].score > pairs[j].score
+	recencyOf := func(id string) int {
+		if r, ok := recency[id]; ok {
+			return r
+		}
+		return len(recency)
+	}
+	// byBoost orders by boost, then recency; relevance, when given, breaks
+	// equal boosts first.
+	byBoost := func(a, b pair, relevance map[string]float64) bool {
+		if a.score != b.score {
+			return a.score > b.score
+		}
+		if ra, rb := relevance[a.id], relevance[b.id]; ra != rb {
+			return ra > rb
 		}
-		key := invertedKey(tokens[0])
-		si, erri := globals.RedisClient.ZScore(ctx, key, pairs[i].id).Result()
-		sj, errj := globals.RedisClient.ZScore(ctx, key, pairs[j].id).Result()
-		if erri != nil || errj != nil {
-			return pairs[i].id < pairs[j].id
+		if ra, rb := recencyOf(a.id), recencyOf(b.id); ra != rb {
+			return ra < rb
 		}
-		return si > sj
-	})
+		return a.id < b.id
+	}
+	sort.Slice(pairs, func(i, j int) bool { return byBoost(pairs[i], pairs[j], nil) })
+
+	// Equal boosts are broken by field-weighted relevance, then recency.
+	// Only the leading maxRankedCandidates are scored; the rest keep their
+	// boost order.
+	head := pairs[:min(len(pairs), maxRankedCandidates)]
+	candidates := make([]string, len(head))
+	for i, p := range head {
+		candidates[i] = p.id
+	}
+	relevance, err := bm25Scores(ctx, tokens, docFreqs, candidates)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(head, func(i, j int) bool { return byBoost(head[i], head[j], relevance) })
 
 	ids := make([]string, 0, len(pairs))
 	for i, p := range pairs {
@@ -707,10 +1055,156 @@ func SearchWithHashtagBoost(ctx context.Context, query string, limit int) ([]str
 
 func GetIndexResults(ctx context.Context, query string, limit int) ([]string, error) {
 	log.Printf("[GetIndexResults] query=%q limit=%d", query, limit)
-	if strings.Contains(query, "#") {
-		log.Println("[GetIndexResults] Detected hashtag, using SearchWithHashtagBoost")
-		return SearchWithHashtagBoost(ctx, query, limit)
+	return searchIndex(ctx, "", query, limit)
+}
+
+// GetIndexResultsForType is GetIndexResults for the entities of entityType,
+// with the query analysed the way they are indexed.
+func GetIndexResultsForType(ctx context.Context, entityType, query string, limit int) ([]string, error) {
+	log.Printf("[GetIndexResultsForType] entityType=%q query=%q limit=%d", entityType, query, limit)
+	return searchIndex(ctx, entityType, query, limit)
+}
+
+// searchIndex runs query with the analyzer and synonyms of entityType over
+// the documents of that type; an empty entityType means every document, the
+// standard analyzer and global synonyms only.
+func searchIndex(ctx context.Context, entityType, query string, limit int) ([]string, error) {
+	plan, err := planSearch(ctx, entityType, query)
+	if err != nil {
+		return nil, err
+	}
+	return plan.rank(ctx, limit)
+}
+
+// searchPlan is how a query runs: the tree to evaluate, the analysed
+// tokens before expansion, the terms scored after it with their boosts,
+// and the ranking strategy.
+type searchPlan struct {
+	entityType string
+	strategy   string
+	node       queryNode
+	tokens     []string
+	terms      []string
+	boosts     map[string]float64
+	hashtags   []string
+}
+
+// planSearch parses query and picks its ranking strategy: hashtag boosting
+// for a plain list of terms with a hashtag, otherwise BM25 after expansion,
+// through the evaluator when the expanded tree is structured. A query with
+// no searchable terms gets StrategyNone.
+func planSearch(ctx context.Context, entityType, query string) (searchPlan, error) {
+	plan := searchPlan{entityType: entityType, strategy: StrategyNone}
+	a := searchAnalyzerFor(entityType)
+	node, err := ParseQueryWith(query, a)
+	if err != nil {
+		log.Printf("[planSearch] parse error: %v", err)
+		return plan, err
+	}
+	if node == nil {
+		return plan, nil
+	}
+	plan.tokens = positiveTerms(node, map[string]bool{}, nil)
+	if isSimpleQuery(node) {
+		for _, t := range plan.tokens {
+			if strings.HasPrefix(t, "#") {
+				plan.hashtags = append(plan.hashtags, t)
+			}
+		}
+	}
+	if len(plan.hashtags) > 0 {
+		plan.strategy, plan.node, plan.terms = StrategyHashtagBoost, node, plan.tokens
+		return plan, nil
+	}
+
+	if node, plan.boosts, err = expandQuery(ctx, entityType, a, node); err != nil {
+		return plan, err
 	}
-	log.Println("[GetIndexResults] No hashtag, using GetIndexedResults")
-	return GetIndexedResults(ctx, query, limit)
+	plan.node, plan.terms = node, positiveTerms(node, map[string]bool{}, nil)
+	plan.strategy = StrategyBM25
+	if !isSimpleQuery(node) {
+		plan.strategy = StrategyBoolean
+	}
+	return plan, nil
+}
+
+// rank runs the plan and returns up to limit matching ids, best first.
+func (p searchPlan) rank(ctx context.Context, limit int) ([]string, error) {
+	switch p.strategy {
+	case StrategyHashtagBoost:
+		log.Println("[searchIndex] Detected hashtag, using searchWithHashtagBoost")
+		return searchWithHashtagBoost(ctx, p.entityType, p.tokens, limit)
+	case StrategyBoolean:
+		log.Println("[searchIndex] Structured query, using evaluateQuery")
+		return evaluateQuery(ctx, p.entityType, p.node, p.boosts, limit)
+	case StrategyBM25:
+		log.Println("[searchIndex] No hashtag, using getIndexedResults")
+		return getIndexedResults(ctx, p.entityType, p.terms, limit)
+	}
+	log.Println("[searchIndex] No searchable terms, returning nil")
+	return nil, nil
+}
+
+// keepType keeps the ids indexed as entityType, in order, checking them
+// against its type set docMetaChunk at a time. An empty entityType keeps
+// every id.
+func keepType(ctx context.Context, ids []string, entityType string) ([]string, error) {
+	if entityType == "" || len(ids) == 0 {
+		return ids, nil
+	}
+	out := make([]string, 0, len(ids))
+	for start := 0; start < len(ids); start += docMetaChunk {
+		chunk := ids[start:min(start+docMetaChunk, len(ids))]
+		members := make([]interface{}, len(chunk))
+		for i, id := range chunk {
+			members[i] = id
+		}
+		in, err := globals.RedisClient.SMIsMember(ctx, typeSetKey(entityType), members...).Result()
+		if err != nil {
+			return nil, err
+		}
+		for i, id := range chunk {
+			if in[i] {
+				out = append(out, id)
+			}
+		}
+	}
+	return out, nil
+}
+
+// expandQuery adds synonyms and, for rare terms, likely spellings to node as
+// weaker alternatives. It returns the new tree and the boosts of the added
+// terms. Expansion turns the query into an OR tree,
+// so it goes through the evaluator.
+func expandQuery(ctx context.Context, entityType string, a *Analyzer, node queryNode) (queryNode, map[string]float64, error) {
+	originals := positiveTerms(node, map[string]bool{}, nil)
+	node, synBoosts, err := expandSynonyms(ctx, entityType, a, node)
+	if err != nil {
+		log.Printf("[expandQuery] expandSynonyms error: %v", err)
+		return nil, nil, err
+	}
+	node, fuzzyBoosts, err := expandFuzzy(ctx, node, originals)
+	if err != nil {
+		log.Printf("[expandQuery] expandFuzzy error: %v", err)
+		return nil, nil, err
+	}
+	return node, mergeBoosts(originals, synBoosts, fuzzyBoosts), nil
+}
+
+// mergeBoosts combines expansion boosts, keeping the highest per term.
+// Terms the user typed always score in full, even when another expansion
+// also produced them.
+func mergeBoosts(originals []string, sets ...map[string]float64) map[string]float64 {
+	out := map[string]float64{}
+	for _, set := range sets {
+		for t, w := range set {
+			if w > out[t] {
+				out[t] = w
+			}
+		}
+	}
+	for _, t := range originals {
+		delete(out, t)
+	}
+	return out
 }
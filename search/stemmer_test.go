@@ -0,0 +1,57 @@
+package search
+
+import "testing"
+
+func TestPorterStem(t *testing.T) {
+	tests := []struct {
+		word, want string
+	}{
+		// Step 1a: plurals.
+		{"caresses", "caress"},
+		{"ponies", "poni"},
+		{"ties", "ti"},
+		{"caress", "caress"},
+		{"cats", "cat"},
+		// Step 1b: -ed and -ing.
+		{"feed", "feed"},
+		{"agreed", "agre"},
+		{"plastered", "plaster"},
+		{"bled", "bled"},
+		{"motoring", "motor"},
+		{"sing", "sing"},
+		{"conflated", "conflat"},
+		{"troubled", "troubl"},
+		{"sized", "size"},
+		{"hopping", "hop"},
+		{"falling", "fall"},
+		{"filing", "file"},
+		// Step 1c: y to i.
+		{"happy", "happi"},
+		{"sky", "sky"},
+		// Steps 2 to 5: suffixes.
+		{"relational", "relat"},
+		{"conditional", "condit"},
+		{"generalization", "gener"},
+		{"hopefulness", "hope"},
+		{"electrical", "electr"},
+		{"adjustment", "adjust"},
+		{"controlling", "control"},
+		{"rate", "rate"},
+		// The examples of the doc comment.
+		{"farms", "farm"},
+		{"farming", "farm"},
+		{"farmed", "farm"},
+		// Short and non-ASCII words are left alone.
+		{"is", "is"},
+		{"as", "as"},
+		{"café", "café"},
+		{"Farms", "Farms"},
+		{"mp3s", "mp3s"},
+		{"#farms", "#farms"},
+	}
+	for _, tt := range tests {
+		if got := PorterStem(tt.word); got != tt.want {
+			t.Errorf("PorterStem(%q) = %q, want %q", tt.word, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,514 @@
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"naevis/globals"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// -------------------------
+// Stop word configuration
+// -------------------------
+
+// StopWordConfig lists stop words per language and per entity type. A
+// language is keyed by analyzer name ("standard", "english") or by a code
+// languageAnalyzers knows ("en"). An entity's stop words are its analyzer's
+// list plus its type's list. KeepInPhrases keeps stop words inside quoted
+// phrases, so "farm to table" does not also match "farm of table".
+//
+// The configuration is read at startup from the JSON file named by
+// SEARCH_STOPWORDS_FILE:
+//
+//	{"languages": {"english": ["the", "a"]}, "types": {"recipes": ["recipe"]}, "keep_in_phrases": true}
+//
+// After changing it, POST /api/v1/admin/stopwords/apply brings the index in
+// line (see ApplyStopWords).
+type StopWordConfig struct {
+	Languages     map[string][]string `json:"languages"`
+	Types         map[string][]string `json:"types,omitempty"`
+	KeepInPhrases bool                `json:"keep_in_phrases,omitempty"`
+
+	analyzers sync.Map // base analyzer name + "/" + entity type -> *Analyzer
+}
+
+var defaultStopWords = []string{"the", "and", "of", "in", "to", "for", "on", "with", "a", "an"}
+
+func defaultStopWordConfig() *StopWordConfig {
+	return &StopWordConfig{Languages: map[string][]string{
+		StandardAnalyzer: defaultStopWords,
+		EnglishAnalyzer:  defaultStopWords,
+	}}
+}
+
+var configuredStopWords = loadStopWordConfig()
+
+func activeStopWords() *StopWordConfig { return configuredStopWords }
+
+func loadStopWordConfig() *StopWordConfig {
+	path := os.Getenv("SEARCH_STOPWORDS_FILE")
+	if path == "" {
+		return defaultStopWordConfig()
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("[loadStopWordConfig] read %q: %v; using defaults", path, err)
+		return defaultStopWordConfig()
+	}
+	c, err := parseStopWordConfig(data)
+	if err != nil {
+		log.Printf("[loadStopWordConfig] parse %q: %v; using defaults", path, err)
+		return defaultStopWordConfig()
+	}
+	log.Printf("[loadStopWordConfig] Loaded %q languages=%d types=%d", path, len(c.Languages), len(c.Types))
+	return c
+}
+
+func parseStopWordConfig(data []byte) (*StopWordConfig, error) {
+	var c StopWordConfig
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	langs := map[string][]string{}
+	for k, words := range c.Languages {
+		k = strings.ToLower(strings.TrimSpace(k))
+		if name, ok := languageAnalyzers[k]; ok {
+			k = name
+		}
+		langs[k] = normalizeStopWords(append(langs[k], words...))
+	}
+	types := map[string][]string{}
+	for k, words := range c.Types {
+		k = strings.ToLower(strings.TrimSpace(k))
+		types[k] = normalizeStopWords(append(types[k], words...))
+	}
+	c.Languages, c.Types = langs, types
+	return &c, nil
+}
+
+// normalizeStopWords normalises words the way text is before tokenizing,
+// drops blanks and duplicates, and sorts them.
+func normalizeStopWords(words []string) []string {
+	seen := map[string]bool{}
+	out := make([]string, 0, len(words))
+	for _, w := range words {
+		w = normalizeText(strings.TrimSpace(w))
+		if w != "" && !seen[w] {
+			seen[w] = true
+			out = append(out, w)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// stopSet returns the stop words of entities of entityType analysed by the
+// analyzer named analyzerName.
+func (c *StopWordConfig) stopSet(analyzerName, entityType string) map[string]bool {
+	set := map[string]bool{}
+	for _, w := range c.Languages[analyzerName] {
+		set[w] = true
+	}
+	for _, w := range c.Types[entityType] {
+		set[w] = true
+	}
+	return set
+}
+
+// analyzer returns base with this configuration's stop words for
+// entityType applied.
+func (c *StopWordConfig) analyzer(base *Analyzer, entityType string) *Analyzer {
+	key := base.Name + "/" + entityType
+	if a, ok := c.analyzers.Load(key); ok {
+		return a.(*Analyzer)
+	}
+	a := *base
+	a.StopWords = c.stopSet(base.Name, entityType)
+	a.KeepStopsInPhrases = c.KeepInPhrases
+	stored, _ := c.analyzers.LoadOrStore(key, &a)
+	return stored.(*Analyzer)
+}
+
+// -------------------------
+// Applying a changed configuration
+// -------------------------
+
+func appliedStopWordsKey() string { return "stopwords:applied" }
+func stopWordsLockKey() string    { return "stopwords:lock" }
+
+// ErrStopWordsBusy is returned when another instance is applying stop words.
+var ErrStopWordsBusy = errors.New("stop word update already running")
+
+// appliedStopWords returns the configuration the index was built with. An
+// index that predates configurable stop words used the defaults.
+func appliedStopWords(ctx context.Context) (*StopWordConfig, error) {
+	data, err := globals.RedisClient.Get(ctx, appliedStopWordsKey()).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return defaultStopWordConfig(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseStopWordConfig(data)
+}
+
+// indexedTerms analyses e as it was indexed: with the applied stop words,
+// which lag the configured ones until an apply has run.
+func indexedTerms(e Entity, applied *StopWordConfig) docTerms {
+	return entityTermsWith(e, applied.analyzer(baseAnalyzerFor(e.EntityType, e.Language), e.EntityType))
+}
+
+// changedStopWords lists the words whose stop word status differs between
+// two configurations for any analyzer and entity type.
+func changedStopWords(from, to *StopWordConfig) []string {
+	words := map[string]bool{}
+	for _, c := range []*StopWordConfig{from, to} {
+		for _, ws := range c.Languages {
+			for _, w := range ws {
+				words[w] = true
+			}
+		}
+		for _, ws := range c.Types {
+			for _, w := range ws {
+				words[w] = true
+			}
+		}
+	}
+
+	var changed []string
+	for w := range words {
+	check:
+		for name := range analyzers {
+			for _, typ := range append([]string{""}, searchableTypes...) {
+				if from.stopSet(name, typ)[w] != to.stopSet(name, typ)[w] {
+					changed = append(changed, w)
+					break check
+				}
+			}
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// StopWordReport describes the outcome of an apply.
+type StopWordReport struct {
+	Changed   []string `json:"changed"`
+	Reindexed int      `json:"reindexed"`
+	Purged    int      `json:"purged"`
+}
+
+func stopWordsStatusKey() string { return "stopwords:status" }
+
+const (
+	// The apply lock expires stopWordsLockTTL after its last renewal, so a
+	// crashed run does not block applies for long; a live run renews it
+	// every stopWordsLockRenew.
+	stopWordsLockTTL   = 2 * time.Minute
+	stopWordsLockRenew = 30 * time.Second
+	// A running apply saves its progress every stopWordsProgressEvery docs.
+	stopWordsProgressEvery = 100
+)
+
+// StopWordApply is the state of the latest apply, kept under
+// stopWordsStatusKey. State is running, done or failed.
+type StopWordApply struct {
+	State      string         `json:"state"`
+	StartedAt  time.Time      `json:"started_at"`
+	FinishedAt *time.Time     `json:"finished_at,omitempty"`
+	Report     StopWordReport `json:"report"`
+	Error      string         `json:"error,omitempty"`
+}
+
+// renewLockScript extends the lock at KEYS[1] to ARGV[2] ms if it is still
+// held with token ARGV[1]; releaseLockScript deletes it on the same
+// condition, so a run never frees a lock taken over by another.
+var renewLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+var releaseLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// StartApplyStopWords takes the apply lock and runs the apply in the
+// background, detached from ctx; its progress and outcome are read with
+// StopWordApplyStatus. ErrStopWordsBusy is returned while another apply
+// holds the lock.
+func StartApplyStopWords(ctx context.Context) (StopWordApply, error) {
+	token := utils.GenerateRandomString(16)
+	st := StopWordApply{State: "running", StartedAt: time.Now().UTC()}
+	ok, err := globals.RedisClient.SetNX(ctx, stopWordsLockKey(), token, stopWordsLockTTL).Result()
+	if err != nil {
+		return st, err
+	}
+	if !ok {
+		return st, ErrStopWordsBusy
+	}
+	if err := saveStopWordApply(ctx, st); err != nil {
+		releaseLockScript.Run(context.Background(), globals.RedisClient, []string{stopWordsLockKey()}, token)
+		return st, err
+	}
+	go runStopWordApply(token, st)
+	return st, nil
+}
+
+// runStopWordApply applies the stop words while holding the lock with
+// token, and records the outcome. Losing the lock cancels the run.
+func runStopWordApply(token string, st StopWordApply) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer releaseLockScript.Run(context.Background(), globals.RedisClient, []string{stopWordsLockKey()}, token)
+	go holdStopWordsLock(ctx, cancel, token)
+
+	err := applyStopWords(ctx, &st.Report, func() {
+		if err := saveStopWordApply(ctx, st); err != nil {
+			log.Printf("[ApplyStopWords] progress error: %v", err)
+		}
+	})
+	finished := time.Now().UTC()
+	st.FinishedAt = &finished
+	st.State = "done"
+	if err != nil {
+		log.Printf("[ApplyStopWords] error: %v", err)
+		st.State, st.Error = "failed", err.Error()
+	}
+	if err := saveStopWordApply(context.Background(), st); err != nil {
+		log.Printf("[ApplyStopWords] status error: %v", err)
+	}
+}
+
+// holdStopWordsLock renews the apply lock until ctx is done, and cancels
+// the run if the lock was lost.
+func holdStopWordsLock(ctx context.Context, cancel context.CancelFunc, token string) {
+	t := time.NewTicker(stopWordsLockRenew)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		n, err := renewLockScript.Run(ctx, globals.RedisClient, []string{stopWordsLockKey()}, token, stopWordsLockTTL.Milliseconds()).Int()
+		if err != nil {
+			// The lock outlives a few failed renewals; try again next tick.
+			log.Printf("[ApplyStopWords] lock renewal error: %v", err)
+			continue
+		}
+		if n == 0 {
+			log.Println("[ApplyStopWords] lock lost, stopping")
+			cancel()
+			return
+		}
+	}
+}
+
+func saveStopWordApply(ctx context.Context, st StopWordApply) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return globals.RedisClient.Set(ctx, stopWordsStatusKey(), data, 0).Err()
+}
+
+// StopWordApplyStatus returns the state of the latest apply, or nil if
+// none was started.
+func StopWordApplyStatus(ctx context.Context) (*StopWordApply, error) {
+	data, err := globals.RedisClient.Get(ctx, stopWordsStatusKey()).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var st StopWordApply
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// applyStopWords brings the index in line with the configured stop words;
+// the caller holds the apply lock. Every document containing a word whose
+// status changed is reindexed: its postings under the previously applied
+// configuration are removed and its postings under the configured one
+// added, so words that became stop words leave inverted: and the term
+// statistics, and words that stopped being stop words get postings.
+// Documents are found through their postings or, for former stop words,
+// their recorded stop word positions. Documents missing from the search
+// collection are unindexed entirely (see purgeTerms). report is filled
+// in as the run goes, and progress is called every stopWordsProgressEvery
+// documents.
+func applyStopWords(ctx context.Context, report *StopWordReport, progress func()) error {
+	log.Println("[ApplyStopWords] START")
+	old, err := appliedStopWords(ctx)
+	if err != nil {
+		return err
+	}
+	current := activeStopWords()
+	report.Changed = changedStopWords(old, current)
+
+	if len(report.Changed) > 0 {
+		ids, err := docsContaining(ctx, report.Changed)
+		if err != nil {
+			return err
+		}
+		log.Printf("[ApplyStopWords] changed=%v docs=%d", report.Changed, len(ids))
+		progress()
+
+		for i, id := range ids {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if i > 0 && i%stopWordsProgressEvery == 0 {
+				progress()
+			}
+			ent, err := FetchEntityFromSearchDB(ctx, id)
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				if err := purgeTerms(ctx, id, report.Changed); err != nil {
+					return err
+				}
+				report.Purged++
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			if err := reindexDocTerms(ctx, ent, indexedTerms(ent, old), entityTerms(ent)); err != nil {
+				return err
+			}
+			report.Reindexed++
+		}
+	}
+
+	data, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+	if err := globals.RedisClient.Set(ctx, appliedStopWordsKey(), data, 0).Err(); err != nil {
+		return err
+	}
+	log.Printf("[ApplyStopWords] END report=%+v", *report)
+	return nil
+}
+
+// docsContaining returns the ids of documents with any of words in their
+// postings or stop word positions.
+func docsContaining(ctx context.Context, words []string) ([]string, error) {
+	pipe := globals.RedisClient.Pipeline()
+	var cmds []*redis.StringSliceCmd
+	for _, w := range words {
+		cmds = append(cmds, pipe.ZRange(ctx, invertedKey(w), 0, -1))
+		for _, f := range indexedFields {
+			cmds = append(cmds, pipe.HKeys(ctx, positionsKey(f, w)))
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+	ids := idSet{}
+	for _, c := range cmds {
+		ids = ids.union(newIDSet(c.Val()))
+	}
+	out := ids.list()
+	sort.Strings(out)
+	return out, nil
+}
+
+// purgeTerms unindexes id, whose source is gone, through the postings
+// recorded under docTermsKey. words are purged as well in case the document
+// was indexed before that key existed.
+func purgeTerms(ctx context.Context, id string, words []string) error {
+	meta, err := getDocMeta(ctx, id)
+	if err != nil {
+		return err
+	}
+	dt, err := storedDocTerms(ctx, id)
+	if err != nil {
+		return err
+	}
+	for _, w := range words {
+		for _, f := range indexedFields {
+			dt.addTerm(f, w)
+			dt.addStopWord(f, w)
+		}
+	}
+	pipe := globals.RedisClient.TxPipeline()
+	unindexDocPipeline(ctx, pipe, id, dt, meta)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// -------------------------
+// Admin handlers
+// -------------------------
+
+// StopWordsHandler shows the configured and applied stop words and the
+// words an apply would reindex.
+func StopWordsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	applied, err := appliedStopWords(r.Context())
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "failed to load applied stop words")
+		return
+	}
+	current := activeStopWords()
+	utils.RespondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"configured": current,
+		"applied":    applied,
+		"pending":    changedStopWords(applied, current),
+	})
+}
+
+// ApplyStopWordsHandler starts an apply in the background and answers 202
+// with its state and where to poll it.
+func ApplyStopWordsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	st, err := StartApplyStopWords(r.Context())
+	if errors.Is(err, ErrStopWordsBusy) {
+		utils.RespondWithError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("[ApplyStopWordsHandler] error: %v", err)
+		utils.RespondWithError(w, http.StatusInternalServerError, "failed to start stop word apply")
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusAccepted, map[string]interface{}{
+		"apply":  st,
+		"status": "/api/v1/admin/stopwords/apply",
+	})
+}
+
+// ApplyStopWordsStatusHandler shows the state of the latest apply.
+func ApplyStopWordsStatusHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	st, err := StopWordApplyStatus(r.Context())
+	if err != nil {
+		log.Printf("[ApplyStopWordsStatusHandler] error: %v", err)
+		utils.RespondWithError(w, http.StatusInternalServerError, "failed to load stop word apply status")
+		return
+	}
+	if st == nil {
+		utils.RespondWithError(w, http.StatusNotFound, "no stop word apply has been started")
+		return
+	}
+	utils.RespondWithJSON(w, http.StatusOK, st)
+}
@@ -0,0 +1,241 @@
+package search
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+
+	"naevis/globals"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// -------------------------
+// "Did you mean" suggestions
+// -------------------------
+
+const (
+	// Corrections considered per misspelled word.
+	suggestCandidates = 3
+	// Misspelled words corrected per query; the rest are left as typed.
+	suggestMaxWords = 4
+)
+
+// queryWord is a run of word characters in the raw query, at rune offsets
+// [start, end).
+type queryWord struct {
+	start, end int
+	text       string
+	terms      []string
+}
+
+// correctableWords finds the words of q a spelling suggestion may replace:
+// not operators, field qualifiers, hashtags, stopwords or words too short
+// or in a script fuzzy matching skips.
+func correctableWords(a *Analyzer, q string) []queryWord {
+	rs := []rune(q)
+	var out []queryWord
+	for i := 0; i < len(rs); {
+		if !isWordRune(rs[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(rs) && isWordRune(rs[j]) {
+			j++
+		}
+		w := queryWord{start: i, end: j, text: string(rs[i:j])}
+		i = j
+
+		switch {
+		case w.start > 0 && rs[w.start-1] == '#':
+			continue
+		case w.end < len(rs) && rs[w.end] == ':' && queryFields[strings.ToLower(w.text)]:
+			continue
+		case w.text == "AND" || w.text == "OR" || w.text == "NOT":
+			continue
+		case strings.IndexFunc(w.text, unicode.IsDigit) >= 0:
+			continue
+		}
+		for _, t := range a.AnalyzeQuery(w.text) {
+			w.terms = append(w.terms, t.Term)
+		}
+		if len(w.terms) == 1 && fuzzyEligible(normalizeText(w.text)) {
+			out = append(out, w)
+		}
+	}
+	return out
+}
+
+// SuggestQuery returns a corrected spelling of query, or "" when every word
+// is already in the index or no correction finds anything. Unknown words
+// are replaced by vocabulary words within their edit budget; among the
+// combinations of corrections, the one whose words occur together in the
+// most documents of entityType wins, with fewer edits and more common words
+// breaking ties. Everything else in the query is kept as typed.
+func SuggestQuery(ctx context.Context, entityType, query string) (string, error) {
+	log.Printf("[SuggestQuery] START entityType=%q query=%q", entityType, query)
+	a := searchAnalyzerFor(entityType)
+	words := correctableWords(a, query)
+	if len(words) == 0 {
+		return "", nil
+	}
+
+	terms := make([]string, 0, len(words))
+	for _, w := range words {
+		terms = append(terms, w.terms[0])
+	}
+	docFreqs, err := documentFrequencies(ctx, terms)
+	if err != nil {
+		return "", err
+	}
+
+	var unknown []int
+	var lookups []string
+	for i, w := range words {
+		if docFreqs[w.terms[0]] == 0 && len(unknown) < suggestMaxWords {
+			unknown = append(unknown, i)
+			lookups = append(lookups, normalizeText(w.text))
+		}
+	}
+	if len(unknown) == 0 {
+		log.Println("[SuggestQuery] No unknown words")
+		return "", nil
+	}
+
+	matches, err := fuzzyCandidates(ctx, lookups)
+	if err != nil {
+		return "", err
+	}
+	options := make([][]fuzzyMatch, len(unknown))
+	for k, l := range lookups {
+		ms := matches[l]
+		if len(ms) == 0 {
+			log.Printf("[SuggestQuery] No candidates for %q", l)
+			return "", nil
+		}
+		if len(ms) > suggestCandidates {
+			ms = ms[:suggestCandidates]
+		}
+		options[k] = ms
+	}
+
+	best, err := bestCorrection(ctx, entityType, words, unknown, options)
+	if err != nil || best == nil {
+		return "", err
+	}
+
+	rs := []rune(query)
+	var b strings.Builder
+	last := 0
+	for k, i := range unknown {
+		b.WriteString(string(rs[last:words[i].start]))
+		b.WriteString(best[k].term)
+		last = words[i].end
+	}
+	b.WriteString(string(rs[last:]))
+	suggestion := b.String()
+	log.Printf("[SuggestQuery] END suggestion=%q", suggestion)
+	return suggestion, nil
+}
+
+// bestCorrection picks one option per unknown word, preferring combinations
+// that co-occur with each other and with the known words in documents of
+// entityType. It returns nil when no combination matches any document.
+func bestCorrection(ctx context.Context, entityType string, words []queryWord, unknown []int, options [][]fuzzyMatch) ([]fuzzyMatch, error) {
+	isUnknown := map[int]bool{}
+	for _, i := range unknown {
+		isUnknown[i] = true
+	}
+
+	pipe := globals.RedisClient.Pipeline()
+	postings := map[string]*redis.StringSliceCmd{}
+	fetch := func(term string) {
+		if _, ok := postings[term]; !ok {
+			postings[term] = pipe.ZRange(ctx, invertedKey(term), 0, -1)
+		}
+	}
+	for i, w := range words {
+		if !isUnknown[i] {
+			fetch(w.terms[0])
+		}
+	}
+	for _, ms := range options {
+		for _, m := range ms {
+			fetch(m.term)
+		}
+	}
+	var typeCmd *redis.StringSliceCmd
+	if entityType != "" {
+		typeCmd = pipe.SMembers(ctx, typeSetKey(entityType))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+
+	var base idSet
+	if typeCmd != nil && len(typeCmd.Val()) > 0 {
+		base = newIDSet(typeCmd.Val())
+	}
+	for i, w := range words {
+		if isUnknown[i] {
+			continue
+		}
+		s := newIDSet(postings[w.terms[0]].Val())
+		if base == nil {
+			base = s
+		} else {
+			base = base.intersect(s)
+		}
+	}
+
+	type combo struct {
+		picks []fuzzyMatch
+		hits  int
+		edits int
+		freq  float64
+	}
+	var combos []combo
+	var walk func(k int, picks []fuzzyMatch, set idSet)
+	walk = func(k int, picks []fuzzyMatch, set idSet) {
+		if len(set) == 0 && k > 0 {
+			return
+		}
+		if k == len(options) {
+			c := combo{picks: append([]fuzzyMatch(nil), picks...), hits: len(set)}
+			for _, m := range picks {
+				c.edits += m.edits
+				c.freq += math.Log1p(float64(m.docFreq))
+			}
+			combos = append(combos, c)
+			return
+		}
+		for _, m := range options[k] {
+			s := newIDSet(postings[m.term].Val())
+			if set != nil {
+				s = set.intersect(s)
+			}
+			walk(k+1, append(picks, m), s)
+		}
+	}
+	walk(0, nil, base)
+
+	if len(combos) == 0 {
+		log.Println("[bestCorrection] No co-occurring correction")
+		return nil, nil
+	}
+	sort.SliceStable(combos, func(i, j int) bool {
+		if combos[i].edits != combos[j].edits {
+			return combos[i].edits < combos[j].edits
+		}
+		if combos[i].hits != combos[j].hits {
+			return combos[i].hits > combos[j].hits
+		}
+		return combos[i].freq > combos[j].freq
+	})
+	return combos[0].picks, nil
+}
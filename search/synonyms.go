@@ -0,0 +1,344 @@
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"naevis/globals"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/redis/go-redis/v9"
+)
+
+// -------------------------
+// Synonym dictionary
+// -------------------------
+
+// synonymWeight scales the score of terms added by synonym expansion.
+const synonymWeight = 0.8
+
+// ErrInvalidSynonym is returned (wrapped) for malformed synonym rules.
+var ErrInvalidSynonym = errors.New("invalid synonym rule")
+
+// SynonymRule is one entry of the synonym dictionary. Without Input the rule
+// is two-way: every entry of Synonyms finds the others (gig, concert, show).
+// With Input it is one-way: the Input words find Synonyms but not the
+// reverse (veg => vegetable, vegetables). Scope limits the rule to one
+// entity type; empty applies it everywhere.
+//
+// Entries may be phrases ("hot dog"); only single words are matched in
+// queries, phrases are used as expansions.
+type SynonymRule struct {
+	ID       string   `json:"id"`
+	Scope    string   `json:"scope,omitempty"`
+	Input    []string `json:"input,omitempty"`
+	Synonyms []string `json:"synonyms"`
+}
+
+func synonymRulesKey() string   { return "synonyms:rules" }
+func synonymVersionKey() string { return "synonyms:version" }
+
+func cleanTerms(in []string) []string {
+	var out []string
+	seen := map[string]bool{}
+	for _, t := range in {
+		t = strings.TrimSpace(t)
+		if k := normalizeText(t); t != "" && !seen[k] {
+			seen[k] = true
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+func (r *SynonymRule) validate() error {
+	r.Scope = strings.ToLower(strings.TrimSpace(r.Scope))
+	r.Input = cleanTerms(r.Input)
+	r.Synonyms = cleanTerms(r.Synonyms)
+	if r.Scope != "" && !contains(searchableTypes, r.Scope) {
+		return fmt.Errorf("%w: unknown scope %q", ErrInvalidSynonym, r.Scope)
+	}
+	if len(r.Input) == 0 && len(r.Synonyms) < 2 {
+		return fmt.Errorf("%w: a two-way rule needs at least two synonyms", ErrInvalidSynonym)
+	}
+	if len(r.Synonyms) == 0 {
+		return fmt.Errorf("%w: synonyms are required", ErrInvalidSynonym)
+	}
+	return nil
+}
+
+// ListSynonyms returns every rule, ordered by ID.
+func ListSynonyms(ctx context.Context) ([]SynonymRule, error) {
+	raw, err := globals.RedisClient.HGetAll(ctx, synonymRulesKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]SynonymRule, 0, len(raw))
+	for id, data := range raw {
+		var rule SynonymRule
+		if err := json.Unmarshal([]byte(data), &rule); err != nil {
+			log.Printf("[ListSynonyms] Skipping malformed rule %q: %v", id, err)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].ID < rules[j].ID })
+	return rules, nil
+}
+
+// SaveSynonym creates or replaces a rule, assigning an ID when it has none.
+func SaveSynonym(ctx context.Context, rule SynonymRule) (SynonymRule, error) {
+	if err := rule.validate(); err != nil {
+		return rule, err
+	}
+	if rule.ID == "" {
+		rule.ID = utils.GenerateRandomString(12)
+	}
+	data, err := json.Marshal(rule)
+	if err != nil {
+		return rule, err
+	}
+	pipe := globals.RedisClient.TxPipeline()
+	pipe.HSet(ctx, synonymRulesKey(), rule.ID, data)
+	pipe.Incr(ctx, synonymVersionKey())
+	_, err = pipe.Exec(ctx)
+	log.Printf("[SaveSynonym] id=%q scope=%q err=%v", rule.ID, rule.Scope, err)
+	return rule, err
+}
+
+// DeleteSynonym removes a rule and reports whether it existed.
+func DeleteSynonym(ctx context.Context, id string) (bool, error) {
+	pipe := globals.RedisClient.TxPipeline()
+	del := pipe.HDel(ctx, synonymRulesKey(), id)
+	pipe.Incr(ctx, synonymVersionKey())
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, err
+	}
+	log.Printf("[DeleteSynonym] id=%q removed=%d", id, del.Val())
+	return del.Val() > 0, nil
+}
+
+// -------------------------
+// Query-time expansion
+// -------------------------
+
+// synonymCache holds the rules compiled per entity type. Every edit bumps
+// synonyms:version, so each instance reloads on its next query after a
+// change without a redeploy.
+type synonymCache struct {
+	mu       sync.Mutex
+	version  string
+	rules    []SynonymRule
+	compiled map[string]map[string][]string
+}
+
+var synonyms synonymCache
+
+// synonymsFor maps each query term, as analysed for entityType, to the
+// synonym texts it expands to.
+func synonymsFor(ctx context.Context, entityType string) (map[string][]string, error) {
+	version, err := globals.RedisClient.Get(ctx, synonymVersionKey()).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+
+	synonyms.mu.Lock()
+	defer synonyms.mu.Unlock()
+	if synonyms.compiled == nil || version != synonyms.version {
+		rules, err := ListSynonyms(ctx)
+		if err != nil {
+			return nil, err
+		}
+		synonyms.version = version
+		synonyms.rules = rules
+		synonyms.compiled = map[string]map[string][]string{}
+		log.Printf("[synonymsFor] Loaded %d rules at version %q", len(rules), version)
+	}
+	if m, ok := synonyms.compiled[entityType]; ok {
+		return m, nil
+	}
+
+	a := searchAnalyzerFor(entityType)
+	single := func(text string) string {
+		if toks := a.AnalyzeQuery(text); len(toks) == 1 {
+			return toks[0].Term
+		}
+		return ""
+	}
+	m := map[string][]string{}
+	add := func(from string, to []string) {
+		key := single(from)
+		if key == "" {
+			return
+		}
+		for _, t := range to {
+			if t != from && !contains(m[key], t) {
+				m[key] = append(m[key], t)
+			}
+		}
+	}
+	for _, rule := range synonyms.rules {
+		if rule.Scope != "" && rule.Scope != entityType {
+			continue
+		}
+		if len(rule.Input) > 0 {
+			for _, in := range rule.Input {
+				add(in, rule.Synonyms)
+			}
+			continue
+		}
+		for _, s := range rule.Synonyms {
+			add(s, rule.Synonyms)
+		}
+	}
+	synonyms.compiled[entityType] = m
+	return m, nil
+}
+
+// expandSynonyms rewrites every non-excluded term of node that has synonyms
+// into an OR of the term and its synonyms, each analysed with a and kept in
+// the term's field. It returns the new tree and the score boost of the
+// added terms.
+func expandSynonyms(ctx context.Context, entityType string, a *Analyzer, node queryNode) (queryNode, map[string]float64, error) {
+	m, err := synonymsFor(ctx, entityType)
+	if err != nil || len(m) == 0 {
+		return node, nil, err
+	}
+	boosts := map[string]float64{}
+	node = rewriteSynonyms(node, a, m, boosts)
+	if len(boosts) > 0 {
+		log.Printf("[expandSynonyms] entityType=%q boosts=%v", entityType, boosts)
+	}
+	return node, boosts, nil
+}
+
+func rewriteSynonyms(node queryNode, a *Analyzer, m map[string][]string, boosts map[string]float64) queryNode {
+	switch n := node.(type) {
+	case termNode:
+		texts := m[n.term]
+		if len(texts) == 0 {
+			return n
+		}
+		or := orNode{children: []queryNode{n}}
+		for _, text := range texts {
+			alt := textNode(a, n.field, text, 0, false)
+			if alt == nil {
+				continue
+			}
+			if t, ok := alt.(termNode); ok && t.term == n.term {
+				continue
+			}
+			or.children = append(or.children, alt)
+			for _, t := range positiveTerms(alt, map[string]bool{}, nil) {
+				boosts[t] = synonymWeight
+			}
+		}
+		if len(or.children) == 1 {
+			return n
+		}
+		return or
+	case andNode:
+		out := andNode{children: make([]queryNode, len(n.children))}
+		for i, c := range n.children {
+			out.children[i] = rewriteSynonyms(c, a, m, boosts)
+		}
+		return out
+	case orNode:
+		out := orNode{children: make([]queryNode, len(n.children))}
+		for i, c := range n.children {
+			out.children[i] = rewriteSynonyms(c, a, m, boosts)
+		}
+		return out
+	}
+	return node
+}
+
+// -------------------------
+// Admin handlers
+// -------------------------
+
+// ListSynonymsHandler returns the synonym rules, optionally only those of
+// ?scope=.
+func ListSynonymsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	rules, err := ListSynonyms(r.Context())
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "failed to load synonyms")
+		return
+	}
+	if scope := strings.ToLower(r.URL.Query().Get("scope")); scope != "" {
+		kept := rules[:0]
+		for _, rule := range rules {
+			if rule.Scope == scope {
+				kept = append(kept, rule)
+			}
+		}
+		rules = kept
+	}
+	utils.RespondWithJSON(w, http.StatusOK, rules)
+}
+
+// CreateSynonymHandler adds a rule.
+func CreateSynonymHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var rule SynonymRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	rule.ID = ""
+	saveSynonymResponse(w, r, rule, http.StatusCreated)
+}
+
+// UpdateSynonymHandler replaces the rule :id.
+func UpdateSynonymHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var rule SynonymRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		utils.RespondWithError(w, http.StatusBadRequest, "invalid JSON")
+		return
+	}
+	rule.ID = ps.ByName("id")
+	exists, err := globals.RedisClient.HExists(r.Context(), synonymRulesKey(), rule.ID).Result()
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "failed to load synonyms")
+		return
+	}
+	if !exists {
+		utils.RespondWithError(w, http.StatusNotFound, "synonym rule not found")
+		return
+	}
+	saveSynonymResponse(w, r, rule, http.StatusOK)
+}
+
+func saveSynonymResponse(w http.ResponseWriter, r *http.Request, rule SynonymRule, status int) {
+	saved, err := SaveSynonym(r.Context(), rule)
+	if errors.Is(err, ErrInvalidSynonym) {
+		utils.RespondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "failed to save synonym rule")
+		return
+	}
+	utils.RespondWithJSON(w, status, saved)
+}
+
+// DeleteSynonymHandler removes the rule :id.
+func DeleteSynonymHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	found, err := DeleteSynonym(r.Context(), ps.ByName("id"))
+	if err != nil {
+		utils.RespondWithError(w, http.StatusInternalServerError, "failed to delete synonym rule")
+		return
+	}
+	if !found {
+		utils.RespondWithError(w, http.StatusNotFound, "synonym rule not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,108 @@
+package search
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// -------------------------
+// Unicode normalisation and segmentation
+// -------------------------
+
+// normalizeText applies NFKC (full-width and compatibility forms become
+// their canonical equivalents, so ｆａｒｍ and ﾊﾟﾝ match farm and パン),
+// lowercases, and folds accents on Latin, Greek and Cyrillic letters so
+// café matches cafe. Combining marks of other scripts are kept: dropping
+// them would turn が into か or break Devanagari vowel signs.
+func normalizeText(s string) string {
+	s = strings.ToLower(norm.NFKC.String(s))
+
+	var b strings.Builder
+	b.Grow(len(s))
+	foldable := false
+	for _, r := range norm.NFD.String(s) {
+		if unicode.Is(unicode.Mn, r) {
+			if foldable {
+				continue
+			}
+		} else {
+			foldable = unicode.In(r, unicode.Latin, unicode.Greek, unicode.Cyrillic)
+		}
+		b.WriteRune(r)
+	}
+	return norm.NFC.String(b.String())
+}
+
+// isCJK reports whether r belongs to a script written without spaces
+// between words.
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul) ||
+		r == 'ー' || r == '々'
+}
+
+// isWordRune reports whether r can be part of a token: a letter, digit or
+// combining mark of any script, or an underscore.
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.IsMark(r) || r == '_'
+}
+
+// unicodeTokens splits normalised text into hashtags and words. Hashtags
+// (#tag) are kept whole in any script. Inside a word, runs of CJK characters
+// are emitted as overlapping bigrams (東京タワー -> 東京 京タ タワ ワー), a single
+// CJK character as itself, and other runs as whole words, so 東京2024 yields
+// 東京 and 2024.
+func unicodeTokens(s string) []string {
+	var out []string
+	rs := []rune(s)
+	for i := 0; i < len(rs); {
+		if rs[i] == '#' && i+1 < len(rs) && isWordRune(rs[i+1]) {
+			j := i + 1
+			for j < len(rs) && isWordRune(rs[j]) {
+				j++
+			}
+			out = append(out, string(rs[i:j]))
+			i = j
+			continue
+		}
+		if !isWordRune(rs[i]) || unicode.IsMark(rs[i]) {
+			i++
+			continue
+		}
+
+		j := i
+		for j < len(rs) && isWordRune(rs[j]) {
+			j++
+		}
+		out = append(out, segmentWord(rs[i:j])...)
+		i = j
+	}
+	return out
+}
+
+// segmentWord splits a word at CJK/non-CJK boundaries and bigrams the CJK
+// runs.
+func segmentWord(word []rune) []string {
+	var out []string
+	for i := 0; i < len(word); {
+		cjk := isCJK(word[i])
+		j := i + 1
+		for j < len(word) && (isCJK(word[j]) == cjk || (unicode.IsMark(word[j]) && !isCJK(word[j]))) {
+			j++
+		}
+		run := word[i:j]
+		switch {
+		case !cjk:
+			out = append(out, string(run))
+		case len(run) == 1:
+			out = append(out, string(run))
+		default:
+			for k := 0; k+1 < len(run); k++ {
+				out = append(out, string(run[k:k+2]))
+			}
+		}
+		i = j
+	}
+	return out
+}
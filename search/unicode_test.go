@@ -0,0 +1,58 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeText(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Café", "cafe"},
+		{"NAÏVE Crème Brûlée", "naive creme brulee"},
+		{"Ελλάδα", "ελλαδα"},
+		{"Ёлка", "елка"},
+		// Full-width and half-width forms.
+		{"ＦＡＲＭ　２０２４", "farm 2024"},
+		{"ﾊﾟﾝ", "パン"},
+		// Combining marks of other scripts are kept.
+		{"が", "が"},
+		{"हिंदी", "हिंदी"},
+		{"#Café", "#cafe"},
+	}
+	for _, tt := range tests {
+		if got := normalizeText(tt.in); got != tt.want {
+			t.Errorf("normalizeText(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestUnicodeTokens(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"fresh farm eggs", []string{"fresh", "farm", "eggs"}},
+		{"farm-fresh, eggs!", []string{"farm", "fresh", "eggs"}},
+		{"snake_case 42", []string{"snake_case", "42"}},
+		{"café", []string{"café"}},
+		// CJK runs become overlapping bigrams; a lone character stays whole.
+		{"東京タワー", []string{"東京", "京タ", "タワ", "ワー"}},
+		{"東京2024", []string{"東京", "2024"}},
+		{"猫", []string{"猫"}},
+		{"東京 tower", []string{"東京", "tower"}},
+		{"서울 여행", []string{"서울", "여행"}},
+		// Hashtags are kept whole in any script.
+		{"#farm life", []string{"#farm", "life"}},
+		{"#東京タワー", []string{"#東京タワー"}},
+		{"#café #", []string{"#café"}},
+		{"a#b", []string{"a", "#b"}},
+	}
+	for _, tt := range tests {
+		if got := unicodeTokens(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("unicodeTokens(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package search
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"naevis/db"
+	"naevis/utils"
+
+	"github.com/julienschmidt/httprouter"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// -------------------------
+// Unified cross-type search
+// -------------------------
+
+const (
+	defaultHitsPerType = 5
+	maxHitsPerType     = 50
+)
+
+// SearchGroup is the slice of a unified search belonging to one entity type.
+type SearchGroup struct {
+	Type  string `json:"type"`
+	Count int    `json:"count"`
+	Hits  []Hit  `json:"hits"`
+}
+
+// GroupedResults is the response of a unified search. Groups are ordered by
+// the rank of their best hit.
+type GroupedResults struct {
+	Query  string        `json:"query"`
+	Total  int           `json:"total"`
+	Groups []SearchGroup `json:"groups"`
+	Facets []Facet       `json:"facets,omitempty"`
+}
+
+// SearchAllTypes runs query once against the shared index and groups the
+// ranked matches by entity type, keeping the count of every group and its
+// perType best hits. types restricts the groups; empty means all searchable
+// types. opts narrows the matches and names the facets to count over them.
+func SearchAllTypes(ctx context.Context, query string, types []string, perType int, opts SearchOptions) (GroupedResults, error) {
+	log.Printf("[SearchAllTypes] START query=%q types=%v perType=%d", query, types, perType)
+	out := GroupedResults{Query: query, Groups: []SearchGroup{}}
+	if len(types) == 0 {
+		types = searchableTypes
+	}
+
+	ids, err := GetIndexResults(ctx, query, 0)
+	if err != nil || len(ids) == 0 {
+		return out, err
+	}
+	typeOf, err := entityTypes(ctx, ids)
+	if err != nil {
+		return out, err
+	}
+	inTypes := ids[:0:0]
+	for _, id := range ids {
+		if contains(types, typeOf[id]) {
+			inTypes = append(inTypes, id)
+		}
+	}
+	ids = inTypes
+	if opts.needsMeta() {
+		if ids, out.Facets, err = applyOptions(ctx, ids, opts); err != nil {
+			return out, err
+		}
+	}
+
+	groups := map[string]*SearchGroup{}
+	var order []string
+	var top []string
+	for _, id := range ids {
+		t := typeOf[id]
+		g, ok := groups[t]
+		if !ok {
+			g = &SearchGroup{Type: t}
+			groups[t] = g
+			order = append(order, t)
+		}
+		g.Count++
+		out.Total++
+		if g.Count <= perType {
+			top = append(top, id)
+		}
+	}
+	if len(top) == 0 {
+		return out, nil
+	}
+
+	cur, err := db.Client.Database("naevis").Collection("search").
+		Find(ctx, bson.M{"entityid": bson.M{"$in": top}})
+	if err != nil {
+		return out, err
+	}
+	var ents []Entity
+	if err := cur.All(ctx, &ents); err != nil {
+		return out, err
+	}
+	byID := make(map[string]Entity, len(ents))
+	for _, e := range ents {
+		byID[e.EntityID] = e
+	}
+
+	for _, id := range top {
+		if e, ok := byID[id]; ok {
+			g := groups[typeOf[id]]
+			g.Hits = append(g.Hits, Hit{Entity: e})
+		}
+	}
+	for _, t := range order {
+		g := groups[t]
+		if g.Hits == nil {
+			g.Hits = []Hit{}
+		}
+		out.Groups = append(out.Groups, *g)
+	}
+	log.Printf("[SearchAllTypes] END total=%d groups=%d", out.Total, len(out.Groups))
+	return out, nil
+}
+
+// entityTypes returns the entity type of each id from its docmeta, falling
+// back to the search collection for documents indexed without one.
+func entityTypes(ctx context.Context, ids []string) (map[string]string, error) {
+	metas, err := fetchDocMetas(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]string, len(ids))
+	var missing []string
+	for i, id := range ids {
+		if t := metas[i]["type"]; t != "" {
+			out[id] = t
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) == 0 {
+		return out, nil
+	}
+
+	opts := options.Find().SetProjection(bson.M{"entityid": 1, "entitytype": 1})
+	cur, err := db.Client.Database("naevis").Collection("search").
+		Find(ctx, bson.M{"entityid": bson.M{"$in": missing}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var rows []Entity
+	if err := cur.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+	for _, e := range rows {
+		out[e.EntityID] = e.EntityType
+	}
+	return out, nil
+}
+
+// UnifiedSearchHandler serves GET /api/v1/search?q=...&types=songs,users&limit=5,
+// where limit is the number of hits per type.
+func UnifiedSearchHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	start := time.Now()
+	q := r.URL.Query()
+	query := strings.TrimSpace(q.Get("q"))
+	if query == "" {
+		query = strings.TrimSpace(q.Get("query"))
+	}
+	if query == "" {
+		writeSearchError(w, http.StatusBadRequest, CodeMissingQuery, "Search query is required")
+		return
+	}
+
+	var types []string
+	for _, t := range strings.Split(q.Get("types"), ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" {
+			continue
+		}
+		if !contains(searchableTypes, t) {
+			writeSearchError(w, http.StatusBadRequest, CodeUnknownEntityType, "Unknown entity type: "+t)
+			return
+		}
+		types = append(types, t)
+	}
+
+	perType := defaultHitsPerType
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeSearchError(w, http.StatusBadRequest, CodeInvalidParameter, "limit must be a positive integer")
+			return
+		}
+		perType = min(n, maxHitsPerType)
+	}
+	hlOpts, highlight, err := highlightOptions(q)
+	if err != nil {
+		writeSearchError(w, http.StatusBadRequest, CodeInvalidParameter, err.Error())
+		return
+	}
+	opts, err := searchOptions(q, types)
+	if err != nil {
+		writeSearchError(w, http.StatusBadRequest, CodeInvalidParameter, err.Error())
+		return
+	}
+
+	res, err := SearchAllTypes(r.Context(), query, types, perType, opts)
+	if errors.Is(err, ErrInvalidQuery) {
+		writeSearchError(w, http.StatusBadRequest, CodeInvalidQuery, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("[UnifiedSearchHandler] error: %v", err)
+		writeSearchError(w, http.StatusInternalServerError, CodeInternal, "Error fetching search results")
+		return
+	}
+
+	if highlight && res.Total > 0 {
+		if hl, err := newHighlighter(r.Context(), "", query, hlOpts); err != nil {
+			log.Printf("[UnifiedSearchHandler] newHighlighter error: %v", err)
+		} else {
+			for _, g := range res.Groups {
+				for i := range g.Hits {
+					g.Hits[i] = hl.hit(g.Hits[i].Entity)
+				}
+			}
+		}
+	}
+
+	meta := newResponseMeta(query, queryTokens("", query), res.Total, start)
+	if len(types) > 0 {
+		meta.Filters["types"] = strings.Join(types, ",")
+	}
+	opts.describe(meta.Filters)
+	if res.Total == 0 {
+		if suggestion, err := SuggestQuery(r.Context(), "", query); err == nil {
+			meta.Suggestion = suggestion
+		}
+	}
+	utils.RespondWithJSON(w, http.StatusOK, UnifiedSearchResponse{ResponseMeta: meta, Groups: res.Groups, Facets: res.Facets})
+}
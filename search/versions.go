@@ -0,0 +1,178 @@
+package search
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"naevis/globals"
+	"naevis/models"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// -------------------------
+// Event versions and tombstones
+// -------------------------
+
+// ErrStaleEvent is returned by IndexDatainRedis and IndexEventBatch for an
+// event older than, or a duplicate of, one already applied to its entity,
+// and for an upsert of an entity deleted since. Such events are skipped.
+var ErrStaleEvent = errors.New("stale or duplicate indexing event")
+
+// tombstoneTTL is how long a delete keeps rejecting older events of its
+// entity.
+const tombstoneTTL = 7 * 24 * time.Hour
+
+// entityVersionKey holds the last applied version of an entity and whether
+// that event deleted it. The hash of a deleted entity is its tombstone and
+// expires after tombstoneTTL.
+func entityVersionKey(entityType, id string) string {
+	return "entityversion:" + strings.ToLower(strings.TrimSpace(entityType)) + ":" + id
+}
+
+// eventVersion returns the version of an event, or 0 when it has none.
+// Timestamps count in microseconds, which Redis scripts compare exactly.
+func eventVersion(e models.Index) int64 {
+	if e.Version > 0 {
+		return e.Version
+	}
+	if !e.Timestamp.IsZero() {
+		return e.Timestamp.UnixMicro()
+	}
+	return 0
+}
+
+type appliedVersion struct {
+	version int64
+	deleted bool
+	found   bool
+}
+
+func getAppliedVersion(ctx context.Context, e models.Index) (appliedVersion, error) {
+	h, err := globals.RedisClient.HGetAll(ctx, entityVersionKey(e.EntityType, e.EntityId)).Result()
+	if err != nil {
+		return appliedVersion{}, err
+	}
+	return parseAppliedVersion(h), nil
+}
+
+// getAppliedVersions is getAppliedVersion for many events, in order, in
+// one pipeline.
+func getAppliedVersions(ctx context.Context, events []models.Index) ([]appliedVersion, error) {
+	pipe := globals.RedisClient.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(events))
+	for i, e := range events {
+		cmds[i] = pipe.HGetAll(ctx, entityVersionKey(e.EntityType, e.EntityId))
+	}
+	if len(events) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+			return nil, err
+		}
+	}
+	out := make([]appliedVersion, len(events))
+	for i, c := range cmds {
+		out[i] = parseAppliedVersion(c.Val())
+	}
+	return out, nil
+}
+
+func parseAppliedVersion(h map[string]string) appliedVersion {
+	if len(h) == 0 {
+		return appliedVersion{}
+	}
+	v, _ := strconv.ParseInt(h["version"], 10, 64)
+	return appliedVersion{version: v, deleted: h["deleted"] == "1", found: true}
+}
+
+// staleReason says why e must be skipped given the last applied event of
+// its entity, or returns "" when e should be applied. An unversioned event
+// is only rejected by a tombstone.
+func staleReason(e models.Index, last appliedVersion) string {
+	if !last.found {
+		return ""
+	}
+	v := eventVersion(e)
+	deleting := strings.EqualFold(e.Method, "DELETE")
+	switch {
+	case last.deleted && deleting:
+		return "already deleted"
+	case last.deleted && (v == 0 || v <= last.version):
+		return "entity was deleted at version " + strconv.FormatInt(last.version, 10)
+	case v > 0 && v <= last.version:
+		return "version " + strconv.FormatInt(v, 10) + " is not newer than " + strconv.FormatInt(last.version, 10)
+	}
+	return ""
+}
+
+// recordVersionScript stores version ARGV[1] and the deleted flag ARGV[2]
+// unless a newer version was recorded meanwhile; version 0 keeps the
+// stored one. A tombstone expires after ARGV[3] ms.
+var recordVersionScript = redis.NewScript(`
+local cur = tonumber(redis.call('HGET', KEYS[1], 'version') or '0')
+local v = tonumber(ARGV[1])
+if v > 0 and v < cur then
+	return 0
+end
+if v > cur then
+	redis.call('HSET', KEYS[1], 'version', ARGV[1])
+elseif cur == 0 then
+	redis.call('HSET', KEYS[1], 'version', '0')
+end
+redis.call('HSET', KEYS[1], 'deleted', ARGV[2])
+if ARGV[2] == '1' then
+	redis.call('PEXPIRE', KEYS[1], ARGV[3])
+else
+	redis.call('PERSIST', KEYS[1])
+end
+return 1
+`)
+
+// recordAppliedVersion remembers that e was applied. Unversioned upserts
+// are not recorded; they cannot order later events.
+func recordAppliedVersion(ctx context.Context, e models.Index) error {
+	keys, args, ok := recordVersionArgs(e)
+	if !ok {
+		return nil
+	}
+	return recordVersionScript.Run(ctx, globals.RedisClient, keys, args...).Err()
+}
+
+// recordAppliedVersionPipeline is recordAppliedVersion queued on pipe.
+func recordAppliedVersionPipeline(ctx context.Context, pipe redis.Pipeliner, e models.Index) {
+	if keys, args, ok := recordVersionArgs(e); ok {
+		recordVersionScript.Eval(ctx, pipe, keys, args...)
+	}
+}
+
+func recordVersionArgs(e models.Index) ([]string, []interface{}, bool) {
+	deleted := strings.EqualFold(e.Method, "DELETE")
+	v := eventVersion(e)
+	if v == 0 && !deleted {
+		return nil, nil, false
+	}
+	flag := "0"
+	if deleted {
+		flag = "1"
+	}
+	return []string{entityVersionKey(e.EntityType, e.EntityId)},
+		[]interface{}{v, flag, tombstoneTTL.Milliseconds()}, true
+}
+
+// afterApplying returns last as recordAppliedVersion leaves it once e is
+// applied, for checking later events of a batch without a round trip.
+func (last appliedVersion) afterApplying(e models.Index) appliedVersion {
+	deleted := strings.EqualFold(e.Method, "DELETE")
+	v := eventVersion(e)
+	if v == 0 && !deleted {
+		return last
+	}
+	if v > last.version {
+		last.version = v
+	}
+	last.deleted = deleted
+	last.found = true
+	return last
+}